@@ -0,0 +1,181 @@
+package cfgsrv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/tonjun/gostore"
+	"github.com/tonjun/pubsub"
+)
+
+// ErrForbidden is the error of a request the ACL does not allow
+var ErrForbidden = errors.New("forbidden")
+
+// ACL is the access policy loaded from Options.ACLFile. It says which ops
+// every identity may call and which subtrees of the config it may read.
+//
+//	{
+//	  "identities": {
+//	    "service-a": {"ops": ["get", "connect"], "paths": ["feature1", "db.replica"]},
+//	    "admin": {"ops": ["*"], "paths": ["*"]}
+//	  },
+//	  "default": {"ops": ["get"], "paths": ["feature1"]}
+//	}
+//
+// The default rule applies to the identities not listed, including
+// connections without an identity. The auth, ping and pong ops are always
+// allowed. The admin ops, stats and queues, are allowed only to the listed
+// identities whose rule grants them. Secret values are released only to the
+// rules with "secrets": true.
+type ACL struct {
+	Identities map[string]*ACLRule `json:"identities"`
+	Default    *ACLRule            `json:"default"`
+}
+
+// ACLRule is the access of a single identity. Paths are dotted config paths
+// and "*" stands for every op or the whole config.
+type ACLRule struct {
+	Ops     []string `json:"ops"`
+	Paths   []string `json:"paths"`
+	Secrets bool     `json:"secrets"`
+}
+
+// LoadACL reads an ACL from a JSON file
+func LoadACL(path string) (*ACL, error) {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	acl := &ACL{}
+	if err := json.Unmarshal(d, acl); err != nil {
+		return nil, fmt.Errorf("parse ACL %s: %s", path, err.Error())
+	}
+	return acl, nil
+}
+
+func (a *ACL) rule(identity string) *ACLRule {
+	if r, found := a.Identities[identity]; found && identity != "" {
+		return r
+	}
+	return a.Default
+}
+
+// Allow returns whether identity may call op. A nil ACL allows everything
+// but the admin ops.
+func (a *ACL) Allow(identity, op string) bool {
+	switch op {
+	case OPAuth, OPPing, OPPong:
+		return true
+	}
+	admin := adminOP(op)
+	if a == nil {
+		return !admin
+	}
+	r := a.rule(identity)
+	if r == nil || (admin && r == a.Default) {
+		return false
+	}
+	for _, o := range r.Ops {
+		if o == "*" || o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// adminOP returns whether op reads the server internals
+func adminOP(op string) bool {
+	return op == OPStats || op == OPQueues
+}
+
+// Redact returns the part of cfg that identity may read. The subtrees not
+// granted by the rule of identity are left out, and so are the Secret values
+// unless the rule allows them. Without an ACL the whole config is readable
+// and secrets are released to authenticated identities only.
+func (a *ACL) Redact(identity string, cfg map[string]interface{}) map[string]interface{} {
+	if a == nil {
+		if identity == "" {
+			return withoutSecrets(cfg).(map[string]interface{})
+		}
+		return cfg
+	}
+	r := a.rule(identity)
+	if r == nil {
+		return make(map[string]interface{})
+	}
+	res := r.selectPaths(cfg)
+	if !r.Secrets {
+		res = withoutSecrets(res).(map[string]interface{})
+	}
+	return res
+}
+
+// selectPaths returns the subtrees of cfg granted by r
+func (r *ACLRule) selectPaths(cfg map[string]interface{}) map[string]interface{} {
+	for _, p := range r.Paths {
+		if p == "*" {
+			return cfg
+		}
+	}
+	res := make(map[string]interface{})
+	copied := make([]string, 0, len(r.Paths))
+	for _, p := range r.Paths {
+		if covered(copied, p) {
+			continue
+		}
+		copyPath(res, cfg, strings.Split(p, "."))
+		copied = append(copied, p)
+	}
+	return res
+}
+
+// covered returns whether path or one of its parents is in paths
+func covered(paths []string, path string) bool {
+	for _, p := range paths {
+		if p == path || strings.HasPrefix(path, p+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// copyPath copies the subtree of src at path into dst, creating the parents
+// in dst as needed. Parents in dst are always maps created here so the
+// subtrees of src are never written to.
+func copyPath(dst, src map[string]interface{}, path []string) {
+	v, found := src[path[0]]
+	if !found {
+		return
+	}
+	if len(path) == 1 {
+		dst[path[0]] = v
+		return
+	}
+	sub, ok := v.(map[string]interface{})
+	if !ok {
+		return
+	}
+	d, ok := dst[path[0]].(map[string]interface{})
+	if !ok {
+		d = make(map[string]interface{})
+	}
+	copyPath(d, sub, path[1:])
+
+	// a parent is only added with something in it, an empty one would
+	// tell the key exists
+	if len(d) > 0 {
+		dst[path[0]] = d
+	}
+}
+
+// connIdentity returns the identity c authenticated as, if any
+func connIdentity(store gostore.Store, c pubsub.Conn) string {
+	item, found, _ := store.Get(fmt.Sprintf("%d-identity", c.ID()))
+	if !found {
+		return ""
+	}
+	return item.Value.(string)
+}
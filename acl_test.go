@@ -0,0 +1,109 @@
+package cfgsrv
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ACL", func() {
+
+	acl := &ACL{
+		Identities: map[string]*ACLRule{
+			"admin":     {Ops: []string{"*"}, Paths: []string{"*"}},
+			"service-a": {Ops: []string{"get", "connect"}, Paths: []string{"feature1"}},
+			"monitor":   {Ops: []string{"stats"}},
+		},
+		Default: &ACLRule{Ops: []string{"*"}, Paths: []string{"*"}},
+	}
+
+	It("should allow the admin ops only to the identities granted them", func() {
+		Expect(acl.Allow("admin", OPStats)).To(BeTrue())
+		Expect(acl.Allow("admin", OPQueues)).To(BeTrue())
+		Expect(acl.Allow("monitor", OPStats)).To(BeTrue())
+		Expect(acl.Allow("monitor", OPQueues)).To(BeFalse())
+		Expect(acl.Allow("service-a", OPStats)).To(BeFalse())
+
+		// the default rule never grants them, even with "*"
+		Expect(acl.Allow("", OPStats)).To(BeFalse())
+		Expect(acl.Allow("unknown", OPQueues)).To(BeFalse())
+		Expect(acl.Allow("unknown", OPGet)).To(BeTrue())
+	})
+
+	It("should allow everything but the admin ops without an ACL", func() {
+		var none *ACL
+		Expect(none.Allow("", OPGet)).To(BeTrue())
+		Expect(none.Allow("admin", OPConnect)).To(BeTrue())
+		Expect(none.Allow("admin", OPStats)).To(BeFalse())
+		Expect(none.Allow("admin", OPQueues)).To(BeFalse())
+	})
+
+	It("should always allow auth, ping and pong", func() {
+		strict := &ACL{Default: &ACLRule{}}
+		Expect(strict.Allow("", OPAuth)).To(BeTrue())
+		Expect(strict.Allow("", OPPing)).To(BeTrue())
+		Expect(strict.Allow("", OPPong)).To(BeTrue())
+		Expect(strict.Allow("", OPGet)).To(BeFalse())
+	})
+
+	Describe("Redact", func() {
+
+		config := func() map[string]interface{} {
+			return map[string]interface{}{
+				"feature1": map[string]interface{}{"enable": true},
+				"db": map[string]interface{}{
+					"primary": map[string]interface{}{"host": "db-1"},
+					"replica": map[string]interface{}{"host": "db-2"},
+				},
+			}
+		}
+
+		It("should return the granted subtrees only", func() {
+			Expect(acl.Redact("service-a", config())).To(Equal(map[string]interface{}{
+				"feature1": map[string]interface{}{"enable": true},
+			}))
+		})
+
+		It("should select nested paths and keep their parents", func() {
+			a := &ACL{Default: &ACLRule{Paths: []string{"db.replica", "db.replica.host", "missing.path"}}}
+			Expect(a.Redact("", config())).To(Equal(map[string]interface{}{
+				"db": map[string]interface{}{
+					"replica": map[string]interface{}{"host": "db-2"},
+				},
+			}))
+		})
+
+		It("should merge the paths under the same parent", func() {
+			a := &ACL{Default: &ACLRule{Paths: []string{"db.primary.host", "db.replica"}}}
+			Expect(a.Redact("", config())).To(Equal(map[string]interface{}{
+				"db": map[string]interface{}{
+					"primary": map[string]interface{}{"host": "db-1"},
+					"replica": map[string]interface{}{"host": "db-2"},
+				},
+			}))
+		})
+
+		It("should not follow a path through a value that is not an object", func() {
+			a := &ACL{Default: &ACLRule{Paths: []string{"feature1.enable.x"}}}
+			Expect(a.Redact("", config())).To(BeEmpty())
+		})
+
+		It("should return the whole config for \"*\"", func() {
+			Expect(acl.Redact("admin", config())).To(Equal(config()))
+		})
+
+		It("should return nothing without a rule", func() {
+			a := &ACL{Identities: map[string]*ACLRule{"admin": {Paths: []string{"*"}}}}
+			Expect(a.Redact("service-a", config())).To(BeEmpty())
+		})
+
+		It("should not change the config", func() {
+			cfg := config()
+			a := &ACL{Default: &ACLRule{Paths: []string{"db.replica"}}}
+			res := a.Redact("", cfg)
+			res["db"].(map[string]interface{})["extra"] = true
+			Expect(cfg).To(Equal(config()))
+		})
+
+	})
+
+})
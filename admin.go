@@ -0,0 +1,46 @@
+package cfgsrv
+
+import (
+	"net"
+	"net/http"
+)
+
+// startAdmin serves the admin endpoints on Options.AdminAddr
+func (s *ConfigServer) startAdmin() error {
+	ln, err := net.Listen("tcp", s.opts.AdminAddr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.serveMetrics)
+	mux.HandleFunc("/healthz", s.serveHealthz)
+	mux.HandleFunc("/readyz", s.serveReadyz)
+	s.admin = newHTTPServer(mux)
+	go func() {
+		if err := s.admin.Serve(ln); err != nil && err != http.ErrServerClosed {
+			s.log.Error("admin server error", Fields{"error": err})
+		}
+	}()
+	return nil
+}
+
+// serveMetrics writes the metrics in the Prometheus text format
+func (s *ConfigServer) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	g := &gauges{
+		connections:   s.adm.count(),
+		peers:         make(map[string]map[string]int),
+		configVersion: s.src.current(),
+	}
+	addrs := peerAddrs(s.store)
+	states := peerStates(s.store, addrs)
+	for _, addr := range addrs {
+		state, found := states[addr]
+		if !found {
+			state = StatePassing
+		}
+		g.peer(peerGroup(s.store, addr), state)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.metrics.write(w, g)
+}
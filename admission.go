@@ -0,0 +1,220 @@
+package cfgsrv
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tonjun/pubsub"
+)
+
+var (
+	// ErrTooManyConnections is the error of a connection over
+	// Options.MaxConns or Options.MaxConnsPerIP
+	ErrTooManyConnections = errors.New("too many connections")
+
+	// ErrTooManyPeers is the error of a connect over Options.MaxPeers
+	ErrTooManyPeers = errors.New("too many peers")
+
+	// ErrRateLimited is the error of a message over Options.MessageRate
+	ErrRateLimited = errors.New("rate limited")
+)
+
+// clientSweep is how often the idle client buckets are dropped
+const clientSweep = time.Second
+
+// admission enforces the connection limits and the message rate. A
+// connection is counted from the moment it is opened, before its first
+// message. A websocket connection has a token bucket of its own, the gateway
+// connections of the same client share one since every HTTP request is a
+// new connection.
+type admission struct {
+	opts      *Options
+	conns     map[string]*admitted // connection ID to admitted connection
+	perIP     map[string]int
+	clients   map[string]*clientBucket // client key to shared bucket
+	lastSweep time.Time
+	mtx       sync.Mutex
+}
+
+// admitted is a connection that passed admission
+type admitted struct {
+	ip     string
+	client string // key of the shared bucket, if any
+	bucket *tokenBucket
+}
+
+// clientBucket is the token bucket shared by the connections of a client
+type clientBucket struct {
+	bucket *tokenBucket
+	refs   int // open connections
+}
+
+func newAdmission(opts *Options) *admission {
+	return &admission{
+		opts:    opts,
+		conns:   make(map[string]*admitted),
+		perIP:   make(map[string]int),
+		clients: make(map[string]*clientBucket),
+	}
+}
+
+// open admits the new connection c if it is within the connection limits.
+// ip is the remote IP of c, empty if unknown. The connections opened with
+// the same non-empty client share their message rate.
+func (a *admission) open(c pubsub.Conn, ip, client string) error {
+	id := fmt.Sprintf("%d", c.ID())
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if _, found := a.conns[id]; found {
+		return nil
+	}
+	if a.opts.MaxConns > 0 && len(a.conns) >= a.opts.MaxConns {
+		return ErrTooManyConnections
+	}
+	if ip != "" && a.opts.MaxConnsPerIP > 0 && a.perIP[ip] >= a.opts.MaxConnsPerIP {
+		return ErrTooManyConnections
+	}
+	conn := &admitted{
+		ip: ip,
+	}
+	if a.opts.MessageRate > 0 && client != "" {
+		a.sweep(time.Now())
+		cb, found := a.clients[client]
+		if !found {
+			cb = &clientBucket{bucket: newTokenBucket(a.opts.MessageRate, a.opts.MessageBurst)}
+			a.clients[client] = cb
+		}
+		cb.refs++
+		conn.client = client
+		conn.bucket = cb.bucket
+	} else if a.opts.MessageRate > 0 {
+		conn.bucket = newTokenBucket(a.opts.MessageRate, a.opts.MessageBurst)
+	}
+	a.conns[id] = conn
+	if ip != "" {
+		a.perIP[ip]++
+	}
+	return nil
+}
+
+// allow returns nil if m of c may be processed. The pongs answer the
+// server pings so they are not charged to the message rate.
+func (a *admission) allow(c pubsub.Conn, m *Message) error {
+	if m.OP == OPPong && m.Type == TypeResponse {
+		return nil
+	}
+	id := fmt.Sprintf("%d", c.ID())
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	conn, found := a.conns[id]
+	if !found {
+		return ErrTooManyConnections
+	}
+	if conn.bucket != nil && !conn.bucket.take(time.Now()) {
+		return ErrRateLimited
+	}
+	return nil
+}
+
+// release forgets c
+func (a *admission) release(c pubsub.Conn) {
+	id := fmt.Sprintf("%d", c.ID())
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	conn, found := a.conns[id]
+	if !found {
+		return
+	}
+	delete(a.conns, id)
+	if conn.ip != "" {
+		if a.perIP[conn.ip]--; a.perIP[conn.ip] <= 0 {
+			delete(a.perIP, conn.ip)
+		}
+	}
+	if cb, found := a.clients[conn.client]; found {
+		cb.refs--
+	}
+}
+
+// sweep drops the buckets of the clients without connections that have
+// refilled, they are no different from a new bucket. Must be called with
+// mtx held.
+func (a *admission) sweep(now time.Time) {
+	if now.Sub(a.lastSweep) < clientSweep {
+		return
+	}
+	a.lastSweep = now
+	for client, cb := range a.clients {
+		if cb.refs <= 0 && cb.bucket.full(now) {
+			delete(a.clients, client)
+		}
+	}
+}
+
+// count returns the number of admitted connections
+func (a *admission) count() int {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return len(a.conns)
+}
+
+// tokenBucket allows rate events per second with bursts of up to burst
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	b := float64(burst)
+	if b < 1 {
+		b = rate
+	}
+	if b < 1 {
+		b = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  b,
+		tokens: b,
+		last:   time.Now(),
+	}
+}
+
+// take spends a token if one is available at t
+func (b *tokenBucket) take(t time.Time) bool {
+	b.tokens += t.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = t
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// full reports whether the bucket has refilled by t
+func (b *tokenBucket) full(t time.Time) bool {
+	return b.tokens+t.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// hostIP returns the IP of a host:port address
+func hostIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ""
+	}
+	return host
+}
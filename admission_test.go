@@ -0,0 +1,167 @@
+package cfgsrv
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("tokenBucket", func() {
+
+	It("should allow a burst and then the rate", func() {
+		b := newTokenBucket(2, 3)
+		now := b.last
+		Expect(b.take(now)).To(BeTrue())
+		Expect(b.take(now)).To(BeTrue())
+		Expect(b.take(now)).To(BeTrue())
+		Expect(b.take(now)).To(BeFalse())
+
+		// 2 per second refills a token every 500ms
+		now = now.Add(499 * time.Millisecond)
+		Expect(b.take(now)).To(BeFalse())
+		now = now.Add(2 * time.Millisecond)
+		Expect(b.take(now)).To(BeTrue())
+		Expect(b.take(now)).To(BeFalse())
+	})
+
+	It("should not refill over the burst", func() {
+		b := newTokenBucket(10, 2)
+		now := b.last.Add(time.Hour)
+		Expect(b.take(now)).To(BeTrue())
+		Expect(b.take(now)).To(BeTrue())
+		Expect(b.take(now)).To(BeFalse())
+	})
+
+	It("should default the burst to the rate", func() {
+		Expect(newTokenBucket(5, 0).burst).To(Equal(5.0))
+		Expect(newTokenBucket(0.5, 0).burst).To(Equal(1.0))
+	})
+
+})
+
+var _ = Describe("admission", func() {
+
+	ping := &Message{OP: OPPing, Type: TypeRequest, ID: "1"}
+	pong := &Message{OP: OPPong, Type: TypeResponse, ID: "1"}
+
+	It("should limit the open connections", func() {
+		a := newAdmission(&Options{MaxConns: 2})
+		c1, c2, c3 := &testConn{id: 1}, &testConn{id: 2}, &testConn{id: 3}
+		Expect(a.open(c1, "10.0.0.1", "")).To(Succeed())
+		Expect(a.open(c2, "10.0.0.2", "")).To(Succeed())
+		Expect(a.open(c3, "10.0.0.3", "")).To(Equal(ErrTooManyConnections))
+		Expect(a.count()).To(Equal(2))
+
+		a.release(c1)
+		Expect(a.open(c3, "10.0.0.3", "")).To(Succeed())
+	})
+
+	It("should limit the open connections per IP", func() {
+		a := newAdmission(&Options{MaxConnsPerIP: 1})
+		c1, c2, c3 := &testConn{id: 1}, &testConn{id: 2}, &testConn{id: 3}
+		Expect(a.open(c1, "10.0.0.1", "")).To(Succeed())
+		Expect(a.open(c2, "10.0.0.1", "")).To(Equal(ErrTooManyConnections))
+		Expect(a.open(c3, "10.0.0.2", "")).To(Succeed())
+
+		a.release(c1)
+		Expect(a.open(c2, "10.0.0.1", "")).To(Succeed())
+	})
+
+	It("should limit the message rate of a connection without charging pongs", func() {
+		a := newAdmission(&Options{MessageRate: 1, MessageBurst: 2})
+		c := &testConn{id: 1}
+		Expect(a.open(c, "10.0.0.1", "")).To(Succeed())
+		Expect(a.allow(c, ping)).To(Succeed())
+		Expect(a.allow(c, ping)).To(Succeed())
+		Expect(a.allow(c, ping)).To(Equal(ErrRateLimited))
+		for i := 0; i < 10; i++ {
+			Expect(a.allow(c, pong)).To(Succeed())
+		}
+	})
+
+	It("should share the message rate of the connections of a client", func() {
+		a := newAdmission(&Options{MessageRate: 1, MessageBurst: 2})
+		for i := int64(1); i <= 2; i++ {
+			c := &testConn{id: i}
+			Expect(a.open(c, "10.0.0.1", "ip:10.0.0.1")).To(Succeed())
+			Expect(a.allow(c, ping)).To(Succeed())
+			a.release(c)
+		}
+		c := &testConn{id: 3}
+		Expect(a.open(c, "10.0.0.1", "ip:10.0.0.1")).To(Succeed())
+		Expect(a.allow(c, ping)).To(Equal(ErrRateLimited))
+
+		other := &testConn{id: 4}
+		Expect(a.open(other, "10.0.0.2", "ip:10.0.0.2")).To(Succeed())
+		Expect(a.allow(other, ping)).To(Succeed())
+	})
+
+	It("should drop the refilled buckets of clients without connections", func() {
+		a := newAdmission(&Options{MessageRate: 1000, MessageBurst: 1})
+		c := &testConn{id: 1}
+		Expect(a.open(c, "10.0.0.1", "ip:10.0.0.1")).To(Succeed())
+		Expect(a.allow(c, ping)).To(Succeed())
+		a.release(c)
+		Expect(a.clients).To(HaveLen(1))
+
+		a.mtx.Lock()
+		a.sweep(time.Now().Add(clientSweep))
+		a.mtx.Unlock()
+		Expect(a.clients).To(BeEmpty())
+	})
+
+	It("should refuse the messages of a connection that is not open", func() {
+		a := newAdmission(&Options{})
+		Expect(a.allow(&testConn{id: 1}, ping)).To(Equal(ErrTooManyConnections))
+	})
+
+})
+
+var _ = Describe("admission of websocket connections", func() {
+
+	var (
+		dir    string
+		addr   string
+		server *ConfigServer
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "cfgsrv-admission")
+		Expect(err).To(BeNil())
+		server, addr = startServer(dir, &Options{MaxConns: 1})
+	})
+
+	AfterEach(func() {
+		server.Stop()
+		os.RemoveAll(dir)
+	})
+
+	It("should count an idle connection against MaxConns", func() {
+		var idle *websocket.Conn
+		Eventually(func() error {
+			var err error
+			idle, _, err = websocket.DefaultDialer.Dial("ws://"+addr, nil)
+			return err
+		}).Should(BeNil())
+		defer idle.Close()
+
+		// the second connection is refused before it sends anything
+		conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr, nil)
+		Expect(err).To(BeNil())
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, data, err := conn.ReadMessage()
+		Expect(err).To(BeNil())
+		Expect(string(data)).To(ContainSubstring(ErrTooManyConnections.Error()))
+		_, _, err = conn.ReadMessage()
+		Expect(err).NotTo(BeNil())
+		Expect(server.adm.count()).To(Equal(1))
+	})
+
+})
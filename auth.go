@@ -0,0 +1,228 @@
+package cfgsrv
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrUnauthorized is returned by an Authenticator for a missing, unknown,
+// expired or badly signed token
+var ErrUnauthorized = errors.New("unauthorized")
+
+// Authenticator verifies the token presented by a connection and returns the
+// identity it belongs to. Set Options.Authenticator to require a token on
+// the first message of every connection.
+type Authenticator interface {
+	Authenticate(token string) (identity string, err error)
+}
+
+// StaticTokenAuth accepts a fixed set of tokens
+type StaticTokenAuth struct {
+	tokens map[string]string // token to identity
+}
+
+// NewStaticTokenAuth creates a StaticTokenAuth from a map of tokens to
+// identities
+func NewStaticTokenAuth(tokens map[string]string) *StaticTokenAuth {
+	return &StaticTokenAuth{
+		tokens: tokens,
+	}
+}
+
+// Authenticate is the implementation of the Authenticator interface
+func (a *StaticTokenAuth) Authenticate(token string) (string, error) {
+	for t, identity := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return identity, nil
+		}
+	}
+	return "", ErrUnauthorized
+}
+
+// HMACTokenAuth accepts tokens of the form identity.expiry.signature where
+// expiry is a unix timestamp and signature is the base64url HMAC-SHA256 of
+// identity.expiry under a shared key. Use SignHMACToken to issue them.
+type HMACTokenAuth struct {
+	key []byte
+}
+
+// NewHMACTokenAuth creates a HMACTokenAuth with the shared key
+func NewHMACTokenAuth(key []byte) *HMACTokenAuth {
+	return &HMACTokenAuth{
+		key: key,
+	}
+}
+
+// SignHMACToken issues a token for identity that expires at expiry
+func SignHMACToken(key []byte, identity string, expiry time.Time) string {
+	payload := fmt.Sprintf("%s.%d", identity, expiry.Unix())
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Authenticate is the implementation of the Authenticator interface
+func (a *HMACTokenAuth) Authenticate(token string) (string, error) {
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return "", ErrUnauthorized
+	}
+	payload, sig := token[:i], token[i+1:]
+
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(payload))
+	expected := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return "", ErrUnauthorized
+	}
+
+	j := strings.LastIndex(payload, ".")
+	if j < 0 {
+		return "", ErrUnauthorized
+	}
+	expiry, err := strconv.ParseInt(payload[j+1:], 10, 64)
+	if err != nil || time.Now().Unix() >= expiry {
+		return "", ErrUnauthorized
+	}
+	return payload[:j], nil
+}
+
+// JWTAuth accepts JSON Web Tokens signed with a local key. The identity is
+// the sub claim, and the exp and nbf claims are enforced when present.
+//
+// The key selects the algorithm: a []byte secret for HS256, a
+// *rsa.PublicKey for RS256, an *ecdsa.PublicKey on P-256 for ES256 and an
+// ed25519.PublicKey for EdDSA.
+type JWTAuth struct {
+	key interface{}
+}
+
+// NewJWTAuth creates a JWTAuth that verifies tokens with key
+func NewJWTAuth(key interface{}) *JWTAuth {
+	return &JWTAuth{
+		key: key,
+	}
+}
+
+// LoadJWTKey reads the verification key of a JWTAuth from a file. A PEM
+// encoded public key is returned as such, anything else is used as the
+// HS256 secret.
+func LoadJWTKey(path string) (interface{}, error) {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(d)
+	if block == nil {
+		return []byte(strings.TrimSpace(string(d))), nil
+	}
+	if block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("unsupported PEM block: %s", block.Type)
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+}
+
+type jwtClaims struct {
+	Sub string `json:"sub"`
+	Exp int64  `json:"exp"`
+	Nbf int64  `json:"nbf"`
+}
+
+// Authenticate is the implementation of the Authenticator interface
+func (a *JWTAuth) Authenticate(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", ErrUnauthorized
+	}
+
+	header := &jwtHeader{}
+	if err := decodeJWTPart(parts[0], header); err != nil {
+		return "", ErrUnauthorized
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", ErrUnauthorized
+	}
+	if !a.verify(header.Alg, []byte(parts[0]+"."+parts[1]), sig) {
+		return "", ErrUnauthorized
+	}
+
+	claims := &jwtClaims{}
+	if err := decodeJWTPart(parts[1], claims); err != nil {
+		return "", ErrUnauthorized
+	}
+	now := time.Now().Unix()
+	if claims.Exp != 0 && now >= claims.Exp {
+		return "", ErrUnauthorized
+	}
+	if claims.Nbf != 0 && now < claims.Nbf {
+		return "", ErrUnauthorized
+	}
+	if claims.Sub == "" {
+		return "", ErrUnauthorized
+	}
+	return claims.Sub, nil
+}
+
+func (a *JWTAuth) verify(alg string, signed, sig []byte) bool {
+	hash := sha256.Sum256(signed)
+
+	switch key := a.key.(type) {
+	case []byte:
+		if alg != "HS256" {
+			return false
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write(signed)
+		return hmac.Equal(sig, mac.Sum(nil))
+
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			return false
+		}
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig) == nil
+
+	case *ecdsa.PublicKey:
+		if alg != "ES256" || len(sig) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(key, hash[:], r, s)
+
+	case ed25519.PublicKey:
+		if alg != "EdDSA" {
+			return false
+		}
+		return ed25519.Verify(key, signed, sig)
+	}
+	return false
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	d, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(d, v)
+}
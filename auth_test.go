@@ -0,0 +1,327 @@
+package cfgsrv
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// jwtToken encodes header and claims and signs them with sign
+func jwtToken(header, claims map[string]interface{}, sign func(signed []byte) []byte) string {
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func hs256(key []byte) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(signed)
+		return mac.Sum(nil)
+	}
+}
+
+var _ = Describe("StaticTokenAuth", func() {
+
+	It("should map the known tokens to their identity", func() {
+		a := NewStaticTokenAuth(map[string]string{"token-a": "service-a"})
+		identity, err := a.Authenticate("token-a")
+		Expect(err).To(BeNil())
+		Expect(identity).To(Equal("service-a"))
+
+		_, err = a.Authenticate("token-b")
+		Expect(err).To(Equal(ErrUnauthorized))
+		_, err = a.Authenticate("")
+		Expect(err).To(Equal(ErrUnauthorized))
+	})
+
+})
+
+var _ = Describe("HMACTokenAuth", func() {
+
+	key := []byte("shared-secret")
+	a := NewHMACTokenAuth(key)
+
+	It("should accept a token signed with the key", func() {
+		identity, err := a.Authenticate(SignHMACToken(key, "service-a", time.Now().Add(time.Minute)))
+		Expect(err).To(BeNil())
+		Expect(identity).To(Equal("service-a"))
+	})
+
+	It("should reject an expired token", func() {
+		_, err := a.Authenticate(SignHMACToken(key, "service-a", time.Now().Add(-time.Second)))
+		Expect(err).To(Equal(ErrUnauthorized))
+	})
+
+	It("should reject a token signed with another key", func() {
+		_, err := a.Authenticate(SignHMACToken([]byte("other"), "service-a", time.Now().Add(time.Minute)))
+		Expect(err).To(Equal(ErrUnauthorized))
+	})
+
+	It("should reject a token with a changed identity or expiry", func() {
+		expiry := time.Now().Add(time.Minute)
+		token := SignHMACToken(key, "service-a", expiry)
+		_, err := a.Authenticate(strings.Replace(token, "service-a", "admin", 1))
+		Expect(err).To(Equal(ErrUnauthorized))
+
+		later := SignHMACToken(key, "service-a", expiry.Add(time.Hour))
+		sig := token[strings.LastIndex(token, "."):]
+		_, err = a.Authenticate(later[:strings.LastIndex(later, ".")] + sig)
+		Expect(err).To(Equal(ErrUnauthorized))
+	})
+
+	It("should reject malformed tokens", func() {
+		for _, token := range []string{"", "service-a", "service-a.123", ".."} {
+			_, err := a.Authenticate(token)
+			Expect(err).To(Equal(ErrUnauthorized))
+		}
+	})
+
+})
+
+var _ = Describe("JWTAuth", func() {
+
+	secret := []byte("jwt-secret")
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"sub": "service-a",
+			"exp": time.Now().Add(time.Minute).Unix(),
+		}
+	}
+
+	It("should accept an HS256 token and return its subject", func() {
+		token := jwtToken(map[string]interface{}{"alg": "HS256"}, valid(), hs256(secret))
+		identity, err := NewJWTAuth(secret).Authenticate(token)
+		Expect(err).To(BeNil())
+		Expect(identity).To(Equal("service-a"))
+	})
+
+	It("should reject an expired or not yet valid token", func() {
+		a := NewJWTAuth(secret)
+		claims := valid()
+		claims["exp"] = time.Now().Add(-time.Second).Unix()
+		_, err := a.Authenticate(jwtToken(map[string]interface{}{"alg": "HS256"}, claims, hs256(secret)))
+		Expect(err).To(Equal(ErrUnauthorized))
+
+		claims = valid()
+		claims["nbf"] = time.Now().Add(time.Minute).Unix()
+		_, err = a.Authenticate(jwtToken(map[string]interface{}{"alg": "HS256"}, claims, hs256(secret)))
+		Expect(err).To(Equal(ErrUnauthorized))
+	})
+
+	It("should reject a token signed with another key or tampered with", func() {
+		a := NewJWTAuth(secret)
+		_, err := a.Authenticate(jwtToken(map[string]interface{}{"alg": "HS256"}, valid(), hs256([]byte("other"))))
+		Expect(err).To(Equal(ErrUnauthorized))
+
+		token := jwtToken(map[string]interface{}{"alg": "HS256"}, valid(), hs256(secret))
+		parts := strings.Split(token, ".")
+		claims := valid()
+		claims["sub"] = "admin"
+		forged := jwtToken(map[string]interface{}{"alg": "HS256"}, claims, hs256(secret))
+		parts[1] = strings.Split(forged, ".")[1]
+		_, err = a.Authenticate(strings.Join(parts, "."))
+		Expect(err).To(Equal(ErrUnauthorized))
+	})
+
+	It("should reject a token without a subject", func() {
+		claims := valid()
+		delete(claims, "sub")
+		_, err := NewJWTAuth(secret).Authenticate(jwtToken(map[string]interface{}{"alg": "HS256"}, claims, hs256(secret)))
+		Expect(err).To(Equal(ErrUnauthorized))
+	})
+
+	It("should verify RS256, ES256 and EdDSA tokens against their public key", func() {
+		rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).To(BeNil())
+		token := jwtToken(map[string]interface{}{"alg": "RS256"}, valid(), func(signed []byte) []byte {
+			hash := sha256.Sum256(signed)
+			sig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, hash[:])
+			Expect(err).To(BeNil())
+			return sig
+		})
+		identity, err := NewJWTAuth(&rsaKey.PublicKey).Authenticate(token)
+		Expect(err).To(BeNil())
+		Expect(identity).To(Equal("service-a"))
+
+		ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).To(BeNil())
+		token = jwtToken(map[string]interface{}{"alg": "ES256"}, valid(), func(signed []byte) []byte {
+			hash := sha256.Sum256(signed)
+			r, s, err := ecdsa.Sign(rand.Reader, ecKey, hash[:])
+			Expect(err).To(BeNil())
+			sig := make([]byte, 64)
+			r.FillBytes(sig[:32])
+			s.FillBytes(sig[32:])
+			return sig
+		})
+		identity, err = NewJWTAuth(&ecKey.PublicKey).Authenticate(token)
+		Expect(err).To(BeNil())
+		Expect(identity).To(Equal("service-a"))
+
+		edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+		Expect(err).To(BeNil())
+		token = jwtToken(map[string]interface{}{"alg": "EdDSA"}, valid(), func(signed []byte) []byte {
+			return ed25519.Sign(edKey, signed)
+		})
+		identity, err = NewJWTAuth(edPub).Authenticate(token)
+		Expect(err).To(BeNil())
+		Expect(identity).To(Equal("service-a"))
+	})
+
+	It("should refuse an HS256 token signed with the public key of an RS256 verifier", func() {
+		rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).To(BeNil())
+		der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+		Expect(err).To(BeNil())
+		pub := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+		// the classic confusion: the public key used as the HMAC secret
+		token := jwtToken(map[string]interface{}{"alg": "HS256"}, valid(), hs256(pub))
+		_, err = NewJWTAuth(&rsaKey.PublicKey).Authenticate(token)
+		Expect(err).To(Equal(ErrUnauthorized))
+		token = jwtToken(map[string]interface{}{"alg": "HS256"}, valid(), hs256(der))
+		_, err = NewJWTAuth(&rsaKey.PublicKey).Authenticate(token)
+		Expect(err).To(Equal(ErrUnauthorized))
+	})
+
+	It("should refuse the none algorithm and the algorithms of other keys", func() {
+		none := jwtToken(map[string]interface{}{"alg": "none"}, valid(), func([]byte) []byte { return nil })
+		_, err := NewJWTAuth(secret).Authenticate(none)
+		Expect(err).To(Equal(ErrUnauthorized))
+
+		edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+		Expect(err).To(BeNil())
+		token := jwtToken(map[string]interface{}{"alg": "HS256"}, valid(), func(signed []byte) []byte {
+			return ed25519.Sign(edKey, signed)
+		})
+		_, err = NewJWTAuth(edPub).Authenticate(token)
+		Expect(err).To(Equal(ErrUnauthorized))
+	})
+
+})
+
+var _ = Describe("authentication of connections", func() {
+
+	var (
+		dir    string
+		addr   string
+		server *ConfigServer
+	)
+
+	// request sends m on conn and returns the next message received
+	request := func(conn *websocket.Conn, m *Message) *Message {
+		Expect(conn.WriteMessage(websocket.TextMessage, m.ToBytes())).To(Succeed())
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, data, err := conn.ReadMessage()
+		Expect(err).To(BeNil())
+		resp := &Message{}
+		Expect(json.Unmarshal(data, resp)).To(Succeed())
+		return resp
+	}
+
+	dial := func() *websocket.Conn {
+		var conn *websocket.Conn
+		Eventually(func() error {
+			var err error
+			conn, _, err = websocket.DefaultDialer.Dial("ws://"+addr, nil)
+			return err
+		}).Should(BeNil())
+		return conn
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "cfgsrv-auth")
+		Expect(err).To(BeNil())
+		acl := writeTemp(dir, "acl.json", `{
+			"identities": {"service-a": {"ops": ["get"], "paths": ["*"]}},
+			"default": {"ops": [], "paths": []}
+		}`)
+		server, addr = startServer(dir, &Options{
+			ACLFile: acl,
+			Authenticator: NewStaticTokenAuth(map[string]string{
+				"token-a": "service-a",
+				"token-b": "service-b",
+			}),
+		})
+	})
+
+	AfterEach(func() {
+		server.Stop()
+		os.RemoveAll(dir)
+	})
+
+	It("should close a connection whose first message has no valid token", func() {
+		for _, token := range []string{"", "wrong"} {
+			conn := dial()
+			resp := request(conn, &Message{OP: OPGet, Type: TypeRequest, ID: "get1", Token: token})
+			Expect(resp.Error).To(Equal(ErrUnauthorized.Error()))
+			Expect(resp.Config).To(BeNil())
+
+			_, _, err := conn.ReadMessage()
+			Expect(err).NotTo(BeNil())
+			conn.Close()
+		}
+	})
+
+	It("should authenticate with a token on the first request", func() {
+		conn := dial()
+		defer conn.Close()
+		resp := request(conn, &Message{OP: OPGet, Type: TypeRequest, ID: "get1", Token: "token-a"})
+		Expect(resp.Error).To(Equal(""))
+		Expect(resp.Config).NotTo(BeNil())
+
+		// the identity holds for the next requests
+		resp = request(conn, &Message{OP: OPGet, Type: TypeRequest, ID: "get2"})
+		Expect(resp.Error).To(Equal(""))
+	})
+
+	It("should set the identity again on every auth op", func() {
+		conn := dial()
+		defer conn.Close()
+		resp := request(conn, &Message{OP: OPAuth, Type: TypeRequest, ID: "a1", Token: "token-a"})
+		Expect(resp.OP).To(Equal(OPAuth))
+		Expect(resp.Error).To(Equal(""))
+		resp = request(conn, &Message{OP: OPGet, Type: TypeRequest, ID: "get1"})
+		Expect(resp.Error).To(Equal(""))
+
+		// service-b may not get the config
+		resp = request(conn, &Message{OP: OPAuth, Type: TypeRequest, ID: "a2", Token: "token-b"})
+		Expect(resp.Error).To(Equal(""))
+		resp = request(conn, &Message{OP: OPGet, Type: TypeRequest, ID: "get2"})
+		Expect(resp.Error).To(Equal(ErrForbidden.Error()))
+	})
+
+	It("should close the connection on an auth op with an invalid token", func() {
+		conn := dial()
+		defer conn.Close()
+		resp := request(conn, &Message{OP: OPAuth, Type: TypeRequest, ID: "a1", Token: "token-a"})
+		Expect(resp.Error).To(Equal(""))
+
+		resp = request(conn, &Message{OP: OPAuth, Type: TypeRequest, ID: "a2", Token: "wrong"})
+		Expect(resp.Error).To(Equal(ErrUnauthorized.Error()))
+		_, _, err := conn.ReadMessage()
+		Expect(err).NotTo(BeNil())
+	})
+
+})
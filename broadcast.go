@@ -0,0 +1,385 @@
+package cfgsrv
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tonjun/pubsub"
+)
+
+// DefaultSendQueueSize is the number of outbound messages buffered per
+// connection when Options.SendQueueSize is not set
+const DefaultSendQueueSize = 64
+
+const (
+	// PolicyDropOldest drops the oldest queued push when a send queue is
+	// over its high-water mark. Responses are dropped only when the queue
+	// holds no push.
+	PolicyDropOldest = "drop_oldest"
+
+	// PolicyCoalesce replaces the queued peers_changed pushes with the
+	// latest one, and drops the oldest push if that is not enough
+	PolicyCoalesce = "coalesce"
+
+	// PolicyDisconnect discards the queue and closes the connection with a
+	// closing push
+	PolicyDisconnect = "disconnect"
+)
+
+// QueueStats is the state of the send queue of a connection as returned by
+// the queues op
+type QueueStats struct {
+	Depth     int   `json:"depth"`
+	MaxDepth  int   `json:"max_depth"`
+	Dropped   int64 `json:"dropped"`
+	Coalesced int64 `json:"coalesced"`
+}
+
+// Broadcaster sends messages through bounded per connection queues. Every
+// queue is drained by its own goroutine, so a slow socket only delays its
+// own messages and never the caller. A connection has a queue from Add to
+// Remove, the messages sent to it at any other time are dropped.
+type Broadcaster struct {
+	size   int
+	policy string
+	direct bool                  // send from the caller, without queues
+	queues map[string]*sendQueue // connection ID to queue
+	mtx    sync.Mutex
+
+	metrics *metrics // records the push fanout latency, if set
+	log     Logger
+}
+
+// NewBroadcaster creates a Broadcaster that buffers up to size messages
+// per connection and applies policy to the connections over that mark
+func NewBroadcaster(size int, policy string) (*Broadcaster, error) {
+	if size <= 0 {
+		size = DefaultSendQueueSize
+	}
+	switch policy {
+	case "":
+		policy = PolicyDropOldest
+	case PolicyDropOldest, PolicyCoalesce, PolicyDisconnect:
+	default:
+		return nil, fmt.Errorf("unknown slow consumer policy: %q", policy)
+	}
+	return &Broadcaster{
+		size:   size,
+		policy: policy,
+		queues: make(map[string]*sendQueue),
+		log:    defaultLogger,
+	}, nil
+}
+
+// newDirectBroadcaster creates a Broadcaster that sends every message from
+// the caller, for the handlers created outside a ConfigServer that has no
+// connection to Add or Remove
+func newDirectBroadcaster() *Broadcaster {
+	b, _ := NewBroadcaster(0, "")
+	b.direct = true
+	return b
+}
+
+// Add creates the send queue of the new connection c
+func (b *Broadcaster) Add(c pubsub.Conn) {
+	id := fmt.Sprintf("%d", c.ID())
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if _, found := b.queues[id]; found {
+		return
+	}
+	q := newSendQueue(c, b.size, b.policy)
+	q.metrics = b.metrics
+	q.log = b.log
+	b.queues[id] = q
+	go q.run()
+}
+
+// Send queues m for c
+func (b *Broadcaster) Send(c pubsub.Conn, m *Message) {
+	if b.direct {
+		b.sendNow(c, m.OP, m.ToBytes())
+		return
+	}
+	if q := b.queue(c); q != nil {
+		q.push(newOutbound(m, m.ToBytes()))
+	}
+}
+
+// SendAndClose queues m as the last message for c and closes c once it is
+// sent
+func (b *Broadcaster) SendAndClose(c pubsub.Conn, m *Message) {
+	if b.direct {
+		b.sendNow(c, m.OP, m.ToBytes())
+		closeConn(c)
+		return
+	}
+	q := b.queue(c)
+	if q == nil {
+		closeConn(c)
+		return
+	}
+	o := newOutbound(m, m.ToBytes())
+	o.close = true
+	q.push(o)
+}
+
+// Broadcast serializes m once and queues it for every connection in conns
+func (b *Broadcaster) Broadcast(conns []pubsub.Conn, m *Message) {
+	data := m.ToBytes()
+	for _, c := range conns {
+		if b.direct {
+			b.sendNow(c, m.OP, data)
+			continue
+		}
+		if q := b.queue(c); q != nil {
+			q.push(newOutbound(m, data))
+		}
+	}
+}
+
+// has reports whether c has a queue, from Add to Remove. Without queues
+// every connection is assumed open.
+func (b *Broadcaster) has(c pubsub.Conn) bool {
+	if b.direct {
+		return true
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	_, found := b.queues[fmt.Sprintf("%d", c.ID())]
+	return found
+}
+
+// Remove drops the queue of c and any message still queued for it. The
+// messages sent to c afterwards are dropped.
+func (b *Broadcaster) Remove(c pubsub.Conn) {
+	id := fmt.Sprintf("%d", c.ID())
+	b.mtx.Lock()
+	q, found := b.queues[id]
+	delete(b.queues, id)
+	b.mtx.Unlock()
+	if found {
+		q.stop()
+	}
+}
+
+// Stats returns the state of every send queue by connection ID
+func (b *Broadcaster) Stats() map[string]*QueueStats {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	stats := make(map[string]*QueueStats)
+	for id, q := range b.queues {
+		stats[id] = q.stats()
+	}
+	return stats
+}
+
+// Close drops all the queues
+func (b *Broadcaster) Close() {
+	b.mtx.Lock()
+	queues := b.queues
+	b.queues = make(map[string]*sendQueue)
+	b.mtx.Unlock()
+	for _, q := range queues {
+		q.stop()
+	}
+}
+
+// sendNow sends data to c from the caller
+func (b *Broadcaster) sendNow(c pubsub.Conn, op string, data []byte) {
+	if err := c.Send(data); err != nil {
+		b.log.Warn("send error", Fields{"conn_id": c.ID(), "op": op, "error": err})
+	}
+}
+
+// queue returns the send queue of c, nil if c was not added or is removed
+func (b *Broadcaster) queue(c pubsub.Conn) *sendQueue {
+	id := fmt.Sprintf("%d", c.ID())
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	q, found := b.queues[id]
+	if !found {
+		b.log.Debug("message to a closed connection dropped", Fields{"conn_id": c.ID()})
+		return nil
+	}
+	return q
+}
+
+// outbound is a serialized message waiting in a sendQueue
+type outbound struct {
+	op     string
+	push   bool
+	close  bool // close the connection once sent
+	data   []byte
+	queued time.Time
+}
+
+func newOutbound(m *Message, data []byte) *outbound {
+	return &outbound{
+		op:     m.OP,
+		push:   m.Type == TypePush,
+		data:   data,
+		queued: time.Now(),
+	}
+}
+
+// sendQueue is the outbound queue of a single connection. Its size is the
+// high-water mark at which the slow consumer policy kicks in.
+type sendQueue struct {
+	conn      pubsub.Conn
+	size      int
+	policy    string
+	items     []*outbound
+	closing   bool
+	maxDepth  int
+	dropped   int64
+	coalesced int64
+	mtx       sync.Mutex
+	ready     chan struct{}
+	done      chan struct{}
+	doneOnce  sync.Once
+	metrics   *metrics
+	log       Logger
+}
+
+func newSendQueue(c pubsub.Conn, size int, policy string) *sendQueue {
+	return &sendQueue{
+		conn:   c,
+		size:   size,
+		policy: policy,
+		items:  make([]*outbound, 0, size),
+		ready:  make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+}
+
+func (q *sendQueue) push(o *outbound) {
+	q.mtx.Lock()
+	if q.closing {
+		// nothing goes out after the last message
+		q.mtx.Unlock()
+		return
+	}
+	if o.close {
+		q.closing = true
+	} else if len(q.items) >= q.size {
+		q.overflow(o)
+	}
+	if !q.closing || o.close {
+		q.items = append(q.items, o)
+	}
+	if len(q.items) > q.maxDepth {
+		q.maxDepth = len(q.items)
+	}
+	q.mtx.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// overflow applies the slow consumer policy to make room for o. Must be
+// called with mtx held.
+func (q *sendQueue) overflow(o *outbound) {
+	switch q.policy {
+	case PolicyDisconnect:
+		q.log.Warn("slow consumer, disconnecting", Fields{"conn_id": q.conn.ID()})
+		q.dropped += int64(len(q.items))
+		closing := &Message{
+			OP:     OPClosing,
+			Type:   TypePush,
+			ID:     fmt.Sprintf("closing-%d", q.conn.ID()),
+			Reason: "slow consumer",
+		}
+		q.items = []*outbound{{
+			op:    OPClosing,
+			push:  true,
+			close: true,
+			data:  closing.ToBytes(),
+		}}
+		q.closing = true
+		return
+
+	case PolicyCoalesce:
+		if o.op == OPPeersChanged {
+			// the new push supersedes the queued ones
+			items := q.items[:0]
+			for _, i := range q.items {
+				if i.op == OPPeersChanged {
+					q.coalesced++
+					continue
+				}
+				items = append(items, i)
+			}
+			q.items = items
+		}
+	}
+
+	if len(q.items) < q.size {
+		return
+	}
+
+	// drop the oldest push, or the oldest message if there is no push
+	drop := 0
+	for i, item := range q.items {
+		if item.push {
+			drop = i
+			break
+		}
+	}
+	op := q.items[drop].op
+	q.items = append(q.items[:drop], q.items[drop+1:]...)
+	q.dropped++
+	q.log.Warn("send queue full, dropped a message", Fields{"conn_id": q.conn.ID(), "op": op})
+}
+
+func (q *sendQueue) pop() *outbound {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if len(q.items) == 0 {
+		return nil
+	}
+	o := q.items[0]
+	q.items = q.items[1:]
+	return o
+}
+
+func (q *sendQueue) stats() *QueueStats {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return &QueueStats{
+		Depth:     len(q.items),
+		MaxDepth:  q.maxDepth,
+		Dropped:   q.dropped,
+		Coalesced: q.coalesced,
+	}
+}
+
+func (q *sendQueue) run() {
+	for {
+		select {
+		case <-q.done:
+			return
+		case <-q.ready:
+		}
+		for o := q.pop(); o != nil; o = q.pop() {
+			if err := q.conn.Send(o.data); err != nil {
+				q.log.Warn("send error", Fields{"conn_id": q.conn.ID(), "op": o.op, "error": err})
+			} else if o.push {
+				q.metrics.pushSent(time.Since(o.queued))
+			}
+			if o.close {
+				closeConn(q.conn)
+				return
+			}
+		}
+	}
+}
+
+func (q *sendQueue) stop() {
+	q.doneOnce.Do(func() {
+		close(q.done)
+	})
+}
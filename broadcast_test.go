@@ -0,0 +1,112 @@
+package cfgsrv
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/tonjun/pubsub"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Broadcaster", func() {
+
+	push := func(op string, i int) *outbound {
+		m := &Message{OP: op, Type: TypePush, ID: fmt.Sprintf("%d", i)}
+		return newOutbound(m, m.ToBytes())
+	}
+
+	ids := func(q *sendQueue) []string {
+		res := make([]string, 0, len(q.items))
+		for _, o := range q.items {
+			m := &Message{}
+			Expect(json.Unmarshal(o.data, m)).To(Succeed())
+			res = append(res, m.OP+"-"+m.ID)
+		}
+		return res
+	}
+
+	It("should refuse an unknown slow consumer policy", func() {
+		_, err := NewBroadcaster(0, "drop_newest")
+		Expect(err).NotTo(BeNil())
+
+		for _, policy := range []string{"", PolicyDropOldest, PolicyCoalesce, PolicyDisconnect} {
+			_, err := NewBroadcaster(0, policy)
+			Expect(err).To(BeNil())
+		}
+	})
+
+	It("should deliver to the added connections", func() {
+		b, _ := NewBroadcaster(0, "")
+		defer b.Close()
+		c := &testConn{id: 1}
+		b.Add(c)
+		b.Send(c, &Message{OP: OPGet, Type: TypeResponse, ID: "1"})
+		Eventually(func() int { return len(c.messages()) }).Should(Equal(1))
+	})
+
+	It("should not create a queue for a removed connection", func() {
+		b, _ := NewBroadcaster(0, "")
+		defer b.Close()
+		c := &testConn{id: 1}
+		b.Add(c)
+		b.Remove(c)
+
+		for i := 0; i < 10; i++ {
+			b.Send(c, &Message{OP: OPConfigChanged, Type: TypePush, ID: "1"})
+			b.Broadcast([]pubsub.Conn{c}, &Message{OP: OPPeersChanged, Type: TypePush, ID: "1"})
+		}
+		Expect(b.Stats()).To(BeEmpty())
+		Consistently(func() int { return len(c.messages()) }).Should(Equal(0))
+	})
+
+	It("should close a connection that was never added on SendAndClose", func() {
+		b, _ := NewBroadcaster(0, "")
+		defer b.Close()
+		c := &testConn{id: 1}
+		b.SendAndClose(c, &Message{OP: OPError, Type: TypeResponse})
+		Expect(c.isClosed()).To(BeTrue())
+		Expect(b.Stats()).To(BeEmpty())
+	})
+
+	Context("over the high-water mark", func() {
+
+		newQueue := func(policy string) *sendQueue {
+			q := newSendQueue(&testConn{id: 1}, 3, policy)
+			q.log = NewJSONLogger(ioutil.Discard, LevelError)
+			return q
+		}
+
+		It("should drop the oldest push with drop_oldest", func() {
+			q := newQueue(PolicyDropOldest)
+			for i := 0; i < 5; i++ {
+				q.push(push(OPConfigChanged, i))
+			}
+			Expect(ids(q)).To(Equal([]string{"config_changed-2", "config_changed-3", "config_changed-4"}))
+			Expect(q.stats().Dropped).To(Equal(int64(2)))
+		})
+
+		It("should keep the latest peers_changed with coalesce", func() {
+			q := newQueue(PolicyCoalesce)
+			q.push(push(OPConfigChanged, 0))
+			q.push(push(OPPeersChanged, 1))
+			q.push(push(OPPeersChanged, 2))
+			q.push(push(OPPeersChanged, 3))
+			Expect(ids(q)).To(Equal([]string{"config_changed-0", "peers_changed-3"}))
+			Expect(q.stats().Coalesced).To(Equal(int64(2)))
+		})
+
+		It("should close the connection with disconnect", func() {
+			q := newQueue(PolicyDisconnect)
+			for i := 0; i < 5; i++ {
+				q.push(push(OPConfigChanged, i))
+			}
+			Expect(ids(q)).To(Equal([]string{"closing-closing-1"}))
+			Expect(q.items[0].close).To(BeTrue())
+		})
+
+	})
+
+})
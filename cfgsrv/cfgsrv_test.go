@@ -1,10 +1,14 @@
 package main_test
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
+	"strings"
 	"time"
 
 	"github.com/onsi/gomega/gbytes"
@@ -65,7 +69,9 @@ func connectClient(addr string, buff *gbytes.Buffer, name string) *wsclient.WSCl
 var _ = Describe("ConfigServer", func() {
 
 	var (
-		server *cfgsrv.ConfigServer
+		server    *cfgsrv.ConfigServer
+		adminAddr string
+		httpAddr  string
 
 		client1 *wsclient.WSClient
 		client2 *wsclient.WSClient
@@ -83,10 +89,14 @@ var _ = Describe("ConfigServer", func() {
 		buffer3 = gbytes.NewBuffer()
 
 		addr := getListenAddress()
+		adminAddr = getListenAddress()
+		httpAddr = getListenAddress()
 
 		// run server
 		server = cfgsrv.NewConfigServer(&cfgsrv.Options{
 			ListenAddr: addr,
+			AdminAddr:  adminAddr,
+			HTTPAddr:   httpAddr,
 			ConfigFile: "./test_config.json",
 			Timeout:    3,
 		})
@@ -114,7 +124,7 @@ var _ = Describe("ConfigServer", func() {
 			"id":   "get1",
 		})
 		Eventually(buffer1).Should(gbytes.Say(
-			`{"op":"get","type":"response","id":"get1","config":\{"feature1":\{"enable":false\},"feature2":\{"enable":true\}\}}`,
+			`{"op":"get","type":"response","id":"get1","config":\{"feature1":\{"enable":false\},"feature2":\{"enable":true\}\},"version":\d+}`,
 		))
 
 	})
@@ -128,7 +138,7 @@ var _ = Describe("ConfigServer", func() {
 			"addr": "127.0.0.1:7171",
 		})
 		Eventually(buffer1).Should(gbytes.Say(
-			`{"op":"connect","type":"response","id":"2","peers":\["127\.0\.0\.1:7171"\],"config":\{"feature1":\{"enable":false\},"feature2":\{"enable":true\}\}}`,
+			`{"op":"connect","type":"response","id":"2","peers":\["127\.0\.0\.1:7171"\],"config":\{"feature1":\{"enable":false\},"feature2":\{"enable":true\}\},"timeout":"3s","heartbeat":\{"interval":"1\.5s","missed":2\},"version":\d+}`,
 		))
 
 	})
@@ -142,7 +152,7 @@ var _ = Describe("ConfigServer", func() {
 			"addr": "127.0.0.1:7171",
 		})
 		Eventually(buffer1).Should(gbytes.Say(
-			`{"op":"connect","type":"response","id":"2","peers":\["127\.0\.0\.1:7171"\],"config":\{"feature1":\{"enable":false\},"feature2":\{"enable":true\}\}}`,
+			`{"op":"connect","type":"response","id":"2","peers":\["127\.0\.0\.1:7171"\],"config":\{"feature1":\{"enable":false\},"feature2":\{"enable":true\}\},"timeout":"3s","heartbeat":\{"interval":"1\.5s","missed":2\},"version":\d+}`,
 		))
 
 		client2.SendJSON(wsclient.M{
@@ -152,7 +162,7 @@ var _ = Describe("ConfigServer", func() {
 			"addr": "192.168.0.100:7171",
 		})
 		Eventually(buffer2).Should(gbytes.Say(
-			`{"op":"connect","type":"response","id":"2","peers":\["127\.0\.0\.1:7171"\,"192\.168\.0\.100:7171"],"config":\{"feature1":\{"enable":false\},"feature2":\{"enable":true\}\}}`,
+			`{"op":"connect","type":"response","id":"2","peers":\["127\.0\.0\.1:7171"\,"192\.168\.0\.100:7171"],"config":\{"feature1":\{"enable":false\},"feature2":\{"enable":true\}\},"timeout":"3s","heartbeat":\{"interval":"1\.5s","missed":2\},"version":\d+}`,
 		))
 
 	})
@@ -166,7 +176,7 @@ var _ = Describe("ConfigServer", func() {
 			"addr": "127.0.0.1:7171",
 		})
 		Eventually(buffer1).Should(gbytes.Say(
-			`{"op":"connect","type":"response","id":"2","peers":\["127\.0\.0\.1:7171"\],"config":\{"feature1":\{"enable":false\},"feature2":\{"enable":true\}\}}`,
+			`{"op":"connect","type":"response","id":"2","peers":\["127\.0\.0\.1:7171"\],"config":\{"feature1":\{"enable":false\},"feature2":\{"enable":true\}\},"timeout":"3s","heartbeat":\{"interval":"1\.5s","missed":2\},"version":\d+}`,
 		))
 		Eventually(buffer1).Should(gbytes.Say(
 			`{"op":"peers_changed","type":"push","id":".","peers":\["127\.0\.0\.1:7171"]}`,
@@ -179,7 +189,7 @@ var _ = Describe("ConfigServer", func() {
 			"addr": "192.168.0.100:7171",
 		})
 		Eventually(buffer2).Should(gbytes.Say(
-			`{"op":"connect","type":"response","id":"2","peers":\["127\.0\.0\.1:7171"\,"192\.168\.0\.100:7171"],"config":\{"feature1":\{"enable":false\},"feature2":\{"enable":true\}\}}`,
+			`{"op":"connect","type":"response","id":"2","peers":\["127\.0\.0\.1:7171"\,"192\.168\.0\.100:7171"],"config":\{"feature1":\{"enable":false\},"feature2":\{"enable":true\}\},"timeout":"3s","heartbeat":\{"interval":"1\.5s","missed":2\},"version":\d+}`,
 		))
 
 		Eventually(buffer1).Should(gbytes.Say(
@@ -196,7 +206,7 @@ var _ = Describe("ConfigServer", func() {
 			"addr": "192.168.0.101:7171",
 		})
 		Eventually(buffer3).Should(gbytes.Say(
-			`{"op":"connect","type":"response","id":"req-client-3","peers":\["127\.0\.0\.1:7171","192\.168\.0\.100:7171","192\.168\.0\.101:7171"],"config":\{"feature1":\{"enable":false\},"feature2":\{"enable":true\}\}}`,
+			`{"op":"connect","type":"response","id":"req-client-3","peers":\["127\.0\.0\.1:7171","192\.168\.0\.100:7171","192\.168\.0\.101:7171"],"config":\{"feature1":\{"enable":false\},"feature2":\{"enable":true\}\},"timeout":"3s","heartbeat":\{"interval":"1\.5s","missed":2\},"version":\d+}`,
 		))
 
 		Eventually(buffer1).Should(gbytes.Say(
@@ -211,6 +221,479 @@ var _ = Describe("ConfigServer", func() {
 
 	})
 
+	It("should let a newer connection take over a registered addr", func() {
+
+		client1.SendJSON(wsclient.M{
+			"op":   "connect",
+			"type": "request",
+			"id":   "2",
+			"addr": "127.0.0.1:7171",
+		})
+		Eventually(buffer1).Should(gbytes.Say(
+			`{"op":"connect","type":"response","id":"2","peers":\["127\.0\.0\.1:7171"\],"config":\{"feature1":\{"enable":false\},"feature2":\{"enable":true\}\},"timeout":"3s","heartbeat":\{"interval":"1\.5s","missed":2\},"version":\d+}`,
+		))
+
+		client2.SendJSON(wsclient.M{
+			"op":   "connect",
+			"type": "request",
+			"id":   "3",
+			"addr": "127.0.0.1:7171",
+		})
+		Eventually(buffer2).Should(gbytes.Say(
+			`{"op":"connect","type":"response","id":"3","peers":\["127\.0\.0\.1:7171"\],"config":\{"feature1":\{"enable":false\},"feature2":\{"enable":true\}\},"timeout":"3s","heartbeat":\{"interval":"1\.5s","missed":2\},"version":\d+}`,
+		))
+		Eventually(buffer1).Should(gbytes.Say(
+			`{"op":"closing","type":"push","id":".","reason":"addr 127\.0\.0\.1:7171 taken over by a newer connection"}`,
+		))
+
+		store := server.GetStore()
+		items, _, _ := store.ListGet("peers")
+		Expect(items).To(HaveLen(1))
+
+	})
+
+	It("op \"disconnect\" should list the peer as draining and then remove it", func() {
+
+		client1.SendJSON(wsclient.M{
+			"op":   "connect",
+			"type": "request",
+			"id":   "2",
+			"addr": "127.0.0.1:7171",
+		})
+		Eventually(buffer1).Should(gbytes.Say(
+			`{"op":"peers_changed","type":"push","id":".","peers":\["127\.0\.0\.1:7171"]}`,
+		))
+
+		client2.SendJSON(wsclient.M{
+			"op":   "connect",
+			"type": "request",
+			"id":   "2",
+			"addr": "192.168.0.100:7171",
+		})
+		Eventually(buffer2).Should(gbytes.Say(
+			`{"op":"peers_changed","type":"push","id":".","peers":\["127\.0\.0\.1:7171","192\.168\.0\.100:7171"]}`,
+		))
+
+		client1.SendJSON(wsclient.M{
+			"op":    "disconnect",
+			"type":  "request",
+			"id":    "3",
+			"drain": "100ms",
+		})
+		Eventually(buffer1).Should(gbytes.Say(
+			`{"op":"disconnect","type":"response","id":"3"}`,
+		))
+		Eventually(buffer2).Should(gbytes.Say(
+			`{"op":"peers_changed","type":"push","id":".","peers":\["127\.0\.0\.1:7171","192\.168\.0\.100:7171"\],"states":\{"127\.0\.0\.1:7171":"draining"\}}`,
+		))
+		Eventually(buffer2).Should(gbytes.Say(
+			`{"op":"peers_changed","type":"push","id":".","peers":\["192\.168\.0\.100:7171"]}`,
+		))
+
+	})
+
+	It("op \"health\" should push the state and filter the peer list", func() {
+
+		client1.SendJSON(wsclient.M{
+			"op":   "connect",
+			"type": "request",
+			"id":   "2",
+			"addr": "127.0.0.1:7171",
+		})
+		Eventually(buffer1).Should(gbytes.Say(
+			`{"op":"peers_changed","type":"push","id":".","peers":\["127\.0\.0\.1:7171"]}`,
+		))
+
+		client2.SendJSON(wsclient.M{
+			"op":   "connect",
+			"type": "request",
+			"id":   "2",
+			"addr": "192.168.0.100:7171",
+		})
+		Eventually(buffer2).Should(gbytes.Say(
+			`{"op":"peers_changed","type":"push","id":".","peers":\["127\.0\.0\.1:7171","192\.168\.0\.100:7171"]}`,
+		))
+
+		client1.SendJSON(wsclient.M{
+			"op":    "health",
+			"type":  "request",
+			"id":    "3",
+			"state": "maintenance",
+		})
+		Eventually(buffer1).Should(gbytes.Say(
+			`{"op":"health","type":"response","id":"3"}`,
+		))
+		Eventually(buffer2).Should(gbytes.Say(
+			`{"op":"peers_changed","type":"push","id":".","peers":\["127\.0\.0\.1:7171","192\.168\.0\.100:7171"\],"states":\{"127\.0\.0\.1:7171":"maintenance"\}}`,
+		))
+
+		client2.SendJSON(wsclient.M{
+			"op":     "peers",
+			"type":   "request",
+			"id":     "4",
+			"filter": []string{"passing"},
+		})
+		Eventually(buffer2).Should(gbytes.Say(
+			`{"op":"peers","type":"response","id":"4","peers":\["192\.168\.0\.100:7171"\]}`,
+		))
+
+		client2.SendJSON(wsclient.M{
+			"op":    "health",
+			"type":  "request",
+			"id":    "5",
+			"state": "sick",
+		})
+		Eventually(buffer2).Should(gbytes.Say(
+			`{"op":"health","type":"response","id":"5","error":"invalid state: \\"sick\\""}`,
+		))
+
+	})
+
+	Describe("with authentication and an ACL", func() {
+
+		var (
+			adminServer *cfgsrv.ConfigServer
+			admin       *wsclient.WSClient
+			adminBuffer *gbytes.Buffer
+			service     *wsclient.WSClient
+			buffer      *gbytes.Buffer
+		)
+
+		BeforeEach(func() {
+			adminBuffer = gbytes.NewBuffer()
+			buffer = gbytes.NewBuffer()
+
+			addr := getListenAddress()
+			adminServer = cfgsrv.NewConfigServer(&cfgsrv.Options{
+				ListenAddr: addr,
+				ConfigFile: "./test_config.json",
+				ACLFile:    "./test_acl.json",
+				Timeout:    3,
+				Authenticator: cfgsrv.NewStaticTokenAuth(map[string]string{
+					"admin-token":   "admin",
+					"service-token": "service-a",
+					"unknown-token": "unknown",
+				}),
+			})
+			go adminServer.Start()
+
+			time.Sleep(10 * time.Millisecond)
+
+			admin = connectClient(addr, adminBuffer, "admin")
+			admin.SendJSON(wsclient.M{
+				"op":    "auth",
+				"type":  "request",
+				"id":    "auth1",
+				"token": "admin-token",
+			})
+			Eventually(adminBuffer).Should(gbytes.Say(
+				`{"op":"auth","type":"response","id":"auth1"}`,
+			))
+
+			service = connectClient(addr, buffer, "service")
+		})
+
+		AfterEach(func() {
+			adminServer.Stop()
+		})
+
+		It("op \"stats\" should return the ping round-trip times per peer", func() {
+
+			admin.SendJSON(wsclient.M{
+				"op":   "connect",
+				"type": "request",
+				"id":   "2",
+				"addr": "127.0.0.1:7171",
+			})
+			Eventually(adminBuffer).Should(gbytes.Say(
+				`{"op":"peers_changed","type":"push","id":".","peers":\["127\.0\.0\.1:7171"]}`,
+			))
+
+			// wait for the first ping round
+			time.Sleep(2 * time.Second)
+
+			admin.SendJSON(wsclient.M{
+				"op":   "stats",
+				"type": "request",
+				"id":   "3",
+			})
+			Eventually(adminBuffer).Should(gbytes.Say(
+				`{"op":"stats","type":"response","id":"3","stats":\{"127\.0\.0\.1:7171":\{"last":"[^"]+","avg":"[^"]+","p50":"[^"]+","p90":"[^"]+","p99":"[^"]+","pongs":1,"last_seen":"[^"]+"\}\}}`,
+			))
+
+		})
+
+		It("op \"queues\" should return the send queue of each connection", func() {
+
+			admin.SendJSON(wsclient.M{
+				"op":   "ping",
+				"type": "request",
+				"id":   "ping1",
+			})
+			Eventually(adminBuffer).Should(gbytes.Say(
+				`{"op":"pong","type":"response","id":"ping1"}`,
+			))
+
+			admin.SendJSON(wsclient.M{
+				"op":   "queues",
+				"type": "request",
+				"id":   "q1",
+			})
+			Eventually(adminBuffer).Should(gbytes.Say(
+				`{"op":"queues","type":"response","id":"q1","queues":\{"\d+":\{"depth":\d+,"max_depth":\d+,"dropped":0,"coalesced":0\}\}}`,
+			))
+
+		})
+
+		It("should close a connection whose first message has no valid token", func() {
+
+			service.SendJSON(wsclient.M{
+				"op":    "get",
+				"type":  "request",
+				"id":    "get1",
+				"token": "wrong-token",
+			})
+			Eventually(buffer).Should(gbytes.Say(
+				`{"op":"get","type":"response","id":"get1","error":"unauthorized"}`,
+			))
+
+		})
+
+		It("should refuse the admin ops to the identities not granted them", func() {
+
+			for _, token := range []string{"service-token", "unknown-token"} {
+				service.SendJSON(wsclient.M{
+					"op":    "auth",
+					"type":  "request",
+					"id":    token,
+					"token": token,
+				})
+				Eventually(buffer).Should(gbytes.Say(
+					`{"op":"auth","type":"response","id":"` + token + `"}`,
+				))
+
+				for _, op := range []string{"stats", "queues"} {
+					service.SendJSON(wsclient.M{
+						"op":   op,
+						"type": "request",
+						"id":   op + "1",
+					})
+					Eventually(buffer).Should(gbytes.Say(
+						`{"op":"` + op + `","type":"response","id":"` + op + `1","error":"forbidden"}`,
+					))
+				}
+			}
+
+		})
+
+	})
+
+	It("should refuse the admin ops without an ACL", func() {
+
+		client1.SendJSON(wsclient.M{
+			"op":   "queues",
+			"type": "request",
+			"id":   "q1",
+		})
+		Eventually(buffer1).Should(gbytes.Say(
+			`{"op":"queues","type":"response","id":"q1","error":"forbidden"}`,
+		))
+
+	})
+
+	It("op \"ping\" from a client should return a pong", func() {
+
+		client1.SendJSON(wsclient.M{
+			"op":   "ping",
+			"type": "request",
+			"id":   "ping1",
+		})
+		Eventually(buffer1).Should(gbytes.Say(
+			`{"op":"pong","type":"response","id":"ping1"}`,
+		))
+
+	})
+
+	It("should serve the metrics", func() {
+
+		client1.SendJSON(wsclient.M{
+			"op":   "get",
+			"type": "request",
+			"id":   "get1",
+		})
+		Eventually(buffer1).Should(gbytes.Say(`"id":"get1"`))
+
+		resp, err := http.Get(fmt.Sprintf("http://%s/metrics", adminAddr))
+		Expect(err).To(BeNil())
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		Expect(string(body)).To(ContainSubstring(`cfgsrv_messages_total{op="get"} 1`))
+		Expect(string(body)).To(MatchRegexp(`cfgsrv_config_version \d+`))
+
+	})
+
+	It("should count the registered peers by group", func() {
+
+		client1.SendJSON(wsclient.M{
+			"op":    "connect",
+			"type":  "request",
+			"id":    "c1",
+			"addr":  "127.0.0.1:7171",
+			"group": "api",
+		})
+		Eventually(buffer1).Should(gbytes.Say(`"id":"c1"`))
+		client2.SendJSON(wsclient.M{
+			"op":   "connect",
+			"type": "request",
+			"id":   "c2",
+			"addr": "127.0.0.1:7172",
+		})
+		Eventually(buffer2).Should(gbytes.Say(`"id":"c2"`))
+
+		resp, err := http.Get(fmt.Sprintf("http://%s/metrics", adminAddr))
+		Expect(err).To(BeNil())
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		Expect(string(body)).To(ContainSubstring(`cfgsrv_peers{group="api",state="passing"} 1`))
+		Expect(string(body)).To(ContainSubstring(`cfgsrv_peers{group="default",state="passing"} 1`))
+
+	})
+
+	It("should refuse an invalid group", func() {
+
+		client1.SendJSON(wsclient.M{
+			"op":    "connect",
+			"type":  "request",
+			"id":    "c1",
+			"addr":  "127.0.0.1:7171",
+			"group": "api\"}",
+		})
+		Eventually(buffer1).Should(gbytes.Say(`"error":"invalid group`))
+
+	})
+
+	It("should serve the health and readiness checks", func() {
+
+		for _, path := range []string{"/healthz", "/readyz"} {
+			resp, err := http.Get(fmt.Sprintf("http://%s%s", adminAddr, path))
+			Expect(err).To(BeNil())
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(string(body)).To(ContainSubstring(`"status":"ok"`))
+		}
+
+	})
+
+	It("should serve the config over HTTP with an ETag", func() {
+
+		resp, err := http.Get(fmt.Sprintf("http://%s/v1/config?path=feature2.enable", httpAddr))
+		Expect(err).To(BeNil())
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(string(body)).To(Equal("true"))
+
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://%s/v1/config?path=feature2.enable", httpAddr), nil)
+		req.Header.Set("If-None-Match", resp.Header.Get("ETag"))
+		resp, err = http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusNotModified))
+
+	})
+
+	It("should register peers over HTTP", func() {
+
+		req, _ := http.NewRequest("PUT", fmt.Sprintf("http://%s/v1/peers/127.0.0.1:7272?ttl=10s", httpAddr), nil)
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		Expect(string(body)).To(Equal(`{"addr":"127.0.0.1:7272","ttl":"10s"}`))
+
+		resp, err = http.Get(fmt.Sprintf("http://%s/v1/peers", httpAddr))
+		Expect(err).To(BeNil())
+		body, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		Expect(string(body)).To(Equal(`{"peers":["127.0.0.1:7272"]}`))
+
+	})
+
+	It("should stream the config changes", func(done Done) {
+
+		resp, err := http.Get(fmt.Sprintf("http://%s/v1/watch", httpAddr))
+		Expect(err).To(BeNil())
+		defer resp.Body.Close()
+		Expect(resp.Header.Get("Content-Type")).To(Equal("text/event-stream"))
+
+		events := bufio.NewReader(resp.Body)
+		line, _ := events.ReadString('\n')
+		Expect(line).To(Equal("event: config_changed\n"))
+		line, _ = events.ReadString('\n')
+		Expect(line).To(MatchRegexp(`"id":"config-\d+"`))
+		first := line
+
+		server.Reload()
+		for {
+			line, err = events.ReadString('\n')
+			Expect(err).To(BeNil())
+			if strings.Contains(line, `"id":"config-`) && line != first {
+				break
+			}
+		}
+		close(done)
+
+	}, 5)
+
+	It("should long poll the config until the wait is over", func() {
+
+		resp, err := http.Get(fmt.Sprintf("http://%s/v1/config", httpAddr))
+		Expect(err).To(BeNil())
+		resp.Body.Close()
+		index := resp.Header.Get("X-Config-Index")
+		Expect(index).NotTo(Equal(""))
+
+		start := time.Now()
+		resp, err = http.Get(fmt.Sprintf("http://%s/v1/config?index=%s&wait=100ms", httpAddr, index))
+		Expect(err).To(BeNil())
+		resp.Body.Close()
+		Expect(time.Since(start)).To(BeNumerically(">=", 100*time.Millisecond))
+		Expect(resp.Header.Get("X-Config-Index")).To(Equal(index))
+
+	})
+
+	It("op \"connect\" should reject an invalid addr", func() {
+
+		client1.SendJSON(wsclient.M{
+			"op":   "connect",
+			"type": "request",
+			"id":   "2",
+			"addr": "node-1",
+		})
+		Eventually(buffer1).Should(gbytes.Say(
+			`{"op":"connect","type":"response","id":"2","error":"invalid addr: \\"node-1\\""}`,
+		))
+
+		store := server.GetStore()
+		_, found, _ := store.ListGet("peers")
+		Expect(found).To(Equal(false))
+
+	})
+
+	It("should reject unknown ops", func() {
+
+		client1.SendJSON(wsclient.M{
+			"op":   "shutdown",
+			"type": "request",
+			"id":   "3",
+		})
+		Eventually(buffer1).Should(gbytes.Say(
+			`{"op":"shutdown","type":"response","id":"3","error":"unknown op: \\"shutdown\\""}`,
+		))
+
+	})
+
 	It("should remove disconnected clients from the memory store", func(done Done) {
 		client1.SendJSON(wsclient.M{
 			"op":   "connect",
@@ -219,7 +702,7 @@ var _ = Describe("ConfigServer", func() {
 			"addr": "127.0.0.1:7171",
 		})
 		Eventually(buffer1).Should(gbytes.Say(
-			`{"op":"connect","type":"response","id":"2","peers":\["127\.0\.0\.1:7171"\],"config":\{"feature1":\{"enable":false\},"feature2":\{"enable":true\}\}}`,
+			`{"op":"connect","type":"response","id":"2","peers":\["127\.0\.0\.1:7171"\],"config":\{"feature1":\{"enable":false\},"feature2":\{"enable":true\}\},"timeout":"3s","heartbeat":\{"interval":"1\.5s","missed":2\},"version":\d+}`,
 		))
 
 		store := server.GetStore()
@@ -241,7 +724,7 @@ var _ = Describe("ConfigServer", func() {
 			"addr": "192.168.0.100:7171",
 		})
 		Eventually(buffer2).Should(gbytes.Say(
-			`{"op":"connect","type":"response","id":"2","peers":\["127\.0\.0\.1:7171"\,"192\.168\.0\.100:7171"],"config":\{"feature1":\{"enable":false\},"feature2":\{"enable":true\}\}}`,
+			`{"op":"connect","type":"response","id":"2","peers":\["127\.0\.0\.1:7171"\,"192\.168\.0\.100:7171"],"config":\{"feature1":\{"enable":false\},"feature2":\{"enable":true\}\},"timeout":"3s","heartbeat":\{"interval":"1\.5s","missed":2\},"version":\d+}`,
 		))
 
 		client1.OnClose(func() {
@@ -275,7 +758,7 @@ var _ = Describe("ConfigServer", func() {
 			"addr": "127.0.0.1:7171",
 		})
 		Eventually(buffer1).Should(gbytes.Say(
-			`{"op":"connect","type":"response","id":"2","peers":\["127\.0\.0\.1:7171"\],"config":\{"feature1":\{"enable":false\},"feature2":\{"enable":true\}\}}`,
+			`{"op":"connect","type":"response","id":"2","peers":\["127\.0\.0\.1:7171"\],"config":\{"feature1":\{"enable":false\},"feature2":\{"enable":true\}\},"timeout":"3s","heartbeat":\{"interval":"1\.5s","missed":2\},"version":\d+}`,
 		))
 		Eventually(buffer1).Should(gbytes.Say(
 			`{"op":"peers_changed","type":"push","id":".","peers":\["127\.0\.0\.1:7171"]}`,
@@ -288,7 +771,7 @@ var _ = Describe("ConfigServer", func() {
 			"addr": "192.168.0.100:7171",
 		})
 		Eventually(buffer2).Should(gbytes.Say(
-			`{"op":"connect","type":"response","id":"2","peers":\["127\.0\.0\.1:7171"\,"192\.168\.0\.100:7171"],"config":\{"feature1":\{"enable":false\},"feature2":\{"enable":true\}\}}`,
+			`{"op":"connect","type":"response","id":"2","peers":\["127\.0\.0\.1:7171"\,"192\.168\.0\.100:7171"],"config":\{"feature1":\{"enable":false\},"feature2":\{"enable":true\}\},"timeout":"3s","heartbeat":\{"interval":"1\.5s","missed":2\},"version":\d+}`,
 		))
 		Eventually(buffer1).Should(gbytes.Say(
 			`{"op":"peers_changed","type":"push","id":".","peers":\["127\.0\.0\.1:7171","192\.168\.0\.100:7171"]}`,
@@ -304,7 +787,7 @@ var _ = Describe("ConfigServer", func() {
 			"addr": "192.168.0.101:7171",
 		})
 		Eventually(buffer3).Should(gbytes.Say(
-			`{"op":"connect","type":"response","id":"req-client-3","peers":\["127\.0\.0\.1:7171","192\.168\.0\.100:7171","192\.168\.0\.101:7171"],"config":\{"feature1":\{"enable":false\},"feature2":\{"enable":true\}\}}`,
+			`{"op":"connect","type":"response","id":"req-client-3","peers":\["127\.0\.0\.1:7171","192\.168\.0\.100:7171","192\.168\.0\.101:7171"],"config":\{"feature1":\{"enable":false\},"feature2":\{"enable":true\}\},"timeout":"3s","heartbeat":\{"interval":"1\.5s","missed":2\},"version":\d+}`,
 		))
 
 		Eventually(buffer1).Should(gbytes.Say(
@@ -1,14 +1,168 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/tonjun/cfgsrv"
 )
 
+const usage = `usage:
+  cfgsrv [-c config.json] [-p port] [-timeout 20s] [-k keyring.json] [-acl acl.json] [-sign key] [-verify reject|flag] [-admin :9090] [-http :8081] [-log-level info]
+  cfgsrv encrypt [-k keyring.json] < value
+  cfgsrv decrypt [-k keyring.json] envelope
+  cfgsrv keygen [-k keyring.json] -id key-id
+`
+
 func main() {
-	fmt.Println("vim-go")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "encrypt":
+			encrypt(os.Args[2:])
+			return
+		case "decrypt":
+			decrypt(os.Args[2:])
+			return
+		case "keygen":
+			keygen(os.Args[2:])
+			return
+		}
+	}
+	serve(os.Args[1:])
+}
+
+func serve(args []string) {
+	fs := flag.NewFlagSet("cfgsrv", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	config := fs.String("c", "config.json", "JSON config file")
+	port := fs.Int("p", 8080, "listen port")
+	timeout := fs.Duration("timeout", 20*time.Second, "ping timeout")
+	keyring := fs.String("k", "", "keyring file for the encrypted config values")
+	acl := fs.String("acl", "", "JSON access policy file")
+	sign := fs.String("sign", "", "ed25519 key that signs the config")
+	admin := fs.String("admin", "", "HTTP listen address of /metrics, /healthz and /readyz")
+	httpAddr := fs.String("http", "", "HTTP listen address of the REST gateway")
+	logLevel := fs.String("log-level", "info", "log level: debug, info, warn or error")
+	verify := fs.String("verify", "", "dial the addr of every connect and reject or flag the unreachable ones")
+	fs.Parse(args)
+
+	level, err := cfgsrv.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	srv := cfgsrv.NewConfigServer(&cfgsrv.Options{
+		ListenAddr:     fmt.Sprintf(":%d", *port),
+		ConfigFile:     *config,
+		Timeout:        int32(*timeout / time.Second),
+		KeyringFile:    *keyring,
+		ACLFile:        *acl,
+		SigningKeyFile: *sign,
+		VerifyAddr:     *verify,
+		AdminAddr:      *admin,
+		HTTPAddr:       *httpAddr,
+		Logger:         cfgsrv.NewJSONLogger(os.Stderr, level),
+	})
+
+	// reload the config on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			srv.Reload()
+		}
+	}()
+
+	if err := srv.Start(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// encrypt prints the $enc value of stdin. The value is never taken from
+// the arguments so it stays out of the process list and the shell history.
+func encrypt(args []string) {
+	fs := flag.NewFlagSet("encrypt", flag.ExitOnError)
+	path := fs.String("k", "keyring.json", "keyring file")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "encrypt reads the value from stdin")
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	d, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		log.Fatal(err)
+	}
+	value := []byte(strings.TrimRight(string(d), "\r\n"))
+
+	k, err := cfgsrv.LoadKeyring(*path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	envelope, err := k.Encrypt(value)
+	if err != nil {
+		log.Fatal(err)
+	}
+	b, _ := json.Marshal(map[string]string{"$enc": envelope})
+	fmt.Println(string(b))
+}
+
+// decrypt prints the plaintext of an envelope or of a {"$enc": envelope} value
+func decrypt(args []string) {
+	fs := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	path := fs.String("k", "keyring.json", "keyring file")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	envelope := fs.Arg(0)
+	v := map[string]string{}
+	if json.Unmarshal([]byte(envelope), &v) == nil && v["$enc"] != "" {
+		envelope = v["$enc"]
+	}
+
+	k, err := cfgsrv.LoadKeyring(*path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	plaintext, err := k.Decrypt(envelope)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(plaintext))
+}
+
+// keygen adds a new primary key to the keyring, creating the keyring file
+// if needed. Values encrypted with the older keys still decrypt.
+func keygen(args []string) {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	path := fs.String("k", "keyring.json", "keyring file")
+	id := fs.String("id", "", "ID of the new key")
+	fs.Parse(args)
 
-	srv := cfgsrv.NewConfigServer(&cfgsrv.Options{})
-	srv.Start()
+	k, err := cfgsrv.LoadKeyring(*path)
+	if os.IsNotExist(err) {
+		k, err = &cfgsrv.Keyring{}, nil
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := k.AddKey(*id); err != nil {
+		log.Fatal(err)
+	}
+	if err := k.Save(*path); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("primary key: %s\n", k.Primary)
 }
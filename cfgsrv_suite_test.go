@@ -0,0 +1,13 @@
+package cfgsrv
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestCfgsrv(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Cfgsrv Unit Suite")
+}
@@ -1,17 +1,157 @@
 package cfgsrv
 
 import (
-	"github.com/tonjun/wsclient"
+	"crypto/ed25519"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
 )
 
+// ClientOptions are the options of a Client
+type ClientOptions struct {
+	TLSConfig *tls.Config   // TLS config for wss://, see LoadClientTLSConfig
+	Token     string        // Token presented to the server Authenticator
+	Timeout   time.Duration // Timeout of a request, defaults to 10s
+
+	// PublicKey is the pinned key of the server. When set, a config is
+	// returned only if its signature verifies against it.
+	PublicKey ed25519.PublicKey
+}
+
+// ErrStaleConfig is returned by GetConfig for a signed config older than
+// the last one accepted with another content, which may be a replay
+var ErrStaleConfig = errors.New("stale config version")
+
+// Client is a config server client
 type Client struct {
-	cli *wsclient.WSClient
+	url  string
+	opts *ClientOptions
+
+	// the last signed config accepted
+	version int64
+	config  string
+	mtx     sync.Mutex
 }
 
+// NewClient creates a Client for the server at serverAddress, which is
+// either a host:port or a ws:// or wss:// URL
 func NewClient(serverAddress string) *Client {
-	return &Client{}
+	return NewClientWithOptions(serverAddress, &ClientOptions{})
+}
+
+// NewClientWithOptions creates a Client with the given options. A host:port
+// serverAddress is reached over wss:// when opts has a TLS config.
+func NewClientWithOptions(serverAddress string, opts *ClientOptions) *Client {
+	url := serverAddress
+	if !strings.HasPrefix(url, "ws://") && !strings.HasPrefix(url, "wss://") {
+		if opts.TLSConfig != nil {
+			url = "wss://" + url
+		} else {
+			url = "ws://" + url
+		}
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	return &Client{
+		url:  url,
+		opts: opts,
+	}
 }
 
+// clientResponse is a server response with the config kept as raw JSON
+type clientResponse struct {
+	OP        string          `json:"op"`
+	Type      string          `json:"type"`
+	ID        string          `json:"id"`
+	Config    json.RawMessage `json:"config"`
+	Version   int64           `json:"version"`
+	Signature string          `json:"signature"`
+	Error     string          `json:"error"`
+}
+
+// GetConfig gets the config with the get op and returns it as JSON
 func (c *Client) GetConfig() (string, error) {
-	return "", nil
+	resp, err := c.request(&Message{
+		OP:    OPGet,
+		Type:  TypeRequest,
+		ID:    "get-1",
+		Token: c.opts.Token,
+	})
+	if err != nil {
+		return "", err
+	}
+	if c.opts.PublicKey != nil {
+		if err := VerifyConfig(c.opts.PublicKey, resp.Version, resp.Config, resp.Signature); err != nil {
+			return "", err
+		}
+		if err := c.accept(resp.Version, string(resp.Config)); err != nil {
+			return "", err
+		}
+	}
+	return string(resp.Config), nil
+}
+
+// accept records a verified config version. The versions are load times
+// and only go up, so a version below the last one accepted, or the same
+// version, with another config is refused as a possible replay. An older
+// version of the same config, from a server that loaded it earlier, is
+// harmless and accepted.
+func (c *Client) accept(version int64, config string) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if version <= c.version {
+		if config != c.config {
+			return ErrStaleConfig
+		}
+		return nil
+	}
+	c.version = version
+	c.config = config
+	return nil
+}
+
+// request sends m on a new connection and waits for its response
+func (c *Client) request(m *Message) (*clientResponse, error) {
+	dialer := &websocket.Dialer{
+		TLSClientConfig:  c.opts.TLSConfig,
+		HandshakeTimeout: c.opts.Timeout,
+	}
+	conn, _, err := dialer.Dial(c.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.WriteMessage(websocket.TextMessage, m.ToBytes()); err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(c.opts.Timeout))
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		resp := &clientResponse{}
+		if err := json.Unmarshal(data, resp); err != nil {
+			return nil, err
+		}
+		// skip the pushes and pings sent in the meantime
+		if resp.Type != TypeResponse || resp.ID != m.ID {
+			continue
+		}
+		if resp.Error != "" {
+			return nil, fmt.Errorf("%s: %s", m.OP, resp.Error)
+		}
+		if resp.OP != m.OP {
+			return nil, errors.New("unexpected response op: " + resp.OP)
+		}
+		return resp, nil
+	}
 }
@@ -0,0 +1,127 @@
+package cfgsrv
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// configSource holds the current config version and serves it as seen by
+// each identity
+type configSource struct {
+	acl     *ACL
+	key     ed25519.PrivateKey // signs every config sent, if set
+	config  map[string]interface{}
+	version int64
+	changed chan struct{} // closed when the version changes
+	mtx     sync.RWMutex
+}
+
+// loadConfigFile reads a JSON config file, resolves its $secret references
+// and decrypts its $enc values
+func loadConfigFile(path string, keyring *Keyring) (map[string]interface{}, error) {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := make(map[string]interface{})
+	if err := json.Unmarshal(d, &config); err != nil {
+		return nil, err
+	}
+	resolved, err := resolveSecrets(config)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := resolved.(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("%s: the config root cannot be a $secret reference", path)
+	}
+	decrypted, err := decryptValues(config, keyring)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := decrypted.(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("%s: the config root cannot be an $enc value", path)
+	}
+	return config, nil
+}
+
+// set makes config the current version and returns its version number.
+// The version is the load time in milliseconds, or the previous version plus
+// one if that is not higher, so the signed versions keep going up across
+// restarts of the server.
+func (s *configSource) set(config map[string]interface{}) int64 {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.config = config
+	version := time.Now().UnixNano() / int64(time.Millisecond)
+	if version <= s.version {
+		version = s.version + 1
+	}
+	s.version = version
+	if s.changed != nil {
+		close(s.changed)
+		s.changed = nil
+	}
+	return s.version
+}
+
+// fill sets the config of m as identity may read it and its version, signed
+// when the source has a key
+func (s *configSource) fill(m *Message, identity string) {
+	s.mtx.RLock()
+	config, version := s.config, s.version
+	s.mtx.RUnlock()
+
+	view := s.acl.Redact(identity, config)
+	m.Version = version
+	if s.key == nil {
+		m.Config = view
+		return
+	}
+
+	// the bytes signed are the bytes sent
+	raw, err := json.Marshal(view)
+	if err != nil {
+		panic(err)
+	}
+	m.Config = json.RawMessage(raw)
+	m.Signature = SignConfig(s.key, version, raw)
+}
+
+// current returns the version being served
+func (s *configSource) current() int64 {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.version
+}
+
+// wait blocks until the version is over index, the timeout runs out or ctx
+// is done, and returns the version
+func (s *configSource) wait(ctx context.Context, index int64, timeout time.Duration) int64 {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		s.mtx.Lock()
+		if version := s.version; version > index {
+			s.mtx.Unlock()
+			return version
+		}
+		if s.changed == nil {
+			s.changed = make(chan struct{})
+		}
+		changed := s.changed
+		s.mtx.Unlock()
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return s.current()
+		case <-ctx.Done():
+			return s.current()
+		}
+	}
+}
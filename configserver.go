@@ -1,41 +1,125 @@
 package cfgsrv
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
 
 	"github.com/tonjun/gostore"
 	"github.com/tonjun/pubsub"
-	"github.com/tonjun/pubsub/wsserver"
 )
 
 type ConfigServer struct {
 	opts     *Options
-	srv      *wsserver.WSServer
-	config   map[string]interface{}
+	ws       *wsServer
+	admin    *http.Server
+	gw       *gateway
+	metrics  *metrics
+	src      *configSource
+	adm      *admission
+	keyring  *Keyring
 	store    gostore.Store
+	bc       *Broadcaster
+	log      Logger
 	handlers []Handler
+	ping     *PingHandler
+	dispatch *dispatchWatch
+	ready    int32 // atomic, 1 once the store is initialized and the handlers set
 	timeout  int32
+	err      error // invalid Options found by NewConfigServer, returned by Start
 }
 
 // Options is the config server options used in NewConfigServer
 type Options struct {
-	ListenAddr string // Websocket listen address
-	ConfigFile string // JSON config file
-	Timeout    int32  // Ping timeout in seconds
+	ListenAddr  string // Websocket listen address
+	ConfigFile  string // JSON config file
+	ACLFile     string // JSON access policy, see ACL. Empty allows everything
+	KeyringFile string // JSON keyring that decrypts the $enc config values, see Keyring
+	AdminAddr   string // HTTP listen address of /metrics, /healthz and /readyz, empty disables it
+	HTTPAddr    string // HTTP listen address of the REST gateway, empty disables it
+
+	SigningKeyFile string        // ed25519 key that signs every config sent, see LoadSigningKey
+	Timeout        int32         // Ping timeout in seconds
+	PingInterval   time.Duration // Interval between pings, defaults to half of Timeout
+	MissedPings    int           // Missed pongs before a peer is evicted, defaults to 2
+	PingJitter     time.Duration // Maximum random delay added to each ping interval
+
+	PeersChangedDelay time.Duration // Window in which peer list changes are coalesced into one peers_changed
+	StallTimeout      time.Duration // Time a message may take before /healthz fails, defaults to DefaultStallTimeout
+
+	SendQueueSize      int    // High-water mark of the outbound queue of a connection, defaults to DefaultSendQueueSize
+	SlowConsumerPolicy string // PolicyDropOldest (default), PolicyCoalesce or PolicyDisconnect
+
+	TLSCert           string // PEM certificate, serves wss:// when set
+	TLSKey            string // PEM private key of TLSCert
+	TLSClientCA       string // PEM CA bundle that signs the client certificates
+	RequireClientCert bool   // Reject clients without a certificate signed by TLSClientCA
+
+	// TLSIdentity maps a verified client certificate to the identity of the
+	// connection. Defaults to the subject common name.
+	TLSIdentity func(cert *x509.Certificate) string
+
+	MaxMessageSize int // Largest message accepted in bytes, defaults to DefaultMaxMessageSize
+
+	VerifyAddr    string        // VerifyReject or VerifyFlag dials the addr of every connect, empty disables it
+	VerifyTimeout time.Duration // Dial timeout of VerifyAddr, defaults to DefaultVerifyTimeout
+
+	MaxConns      int     // Maximum open connections, 0 is unlimited
+	MaxConnsPerIP int     // Maximum open connections per remote IP, 0 is unlimited
+	MaxPeers      int     // Maximum registered peers, 0 is unlimited
+	MessageRate   float64 // Messages per second allowed per connection, 0 is unlimited
+	MessageBurst  int     // Burst of messages allowed over MessageRate, defaults to MessageRate
+
+	// Authenticator verifies the token on the first message of every
+	// connection. Nil disables authentication.
+	Authenticator Authenticator
+
+	// Logger receives the server logs. Defaults to JSON lines on stderr at
+	// LevelInfo, the per message logs are at LevelDebug.
+	Logger Logger
+
+	// FailureDetector decides when a silent peer is suspect or dead. The
+	// default evicts a peer once MissedPings pongs are missing.
+	FailureDetector FailureDetector
 }
 
 // NewConfigServer creates a new instance of ConfigServer
 func NewConfigServer(opts *Options) *ConfigServer {
+	logger := loggerOf(opts)
+	mt := newMetrics()
+	bc, err := NewBroadcaster(opts.SendQueueSize, opts.SlowConsumerPolicy)
+	if err != nil {
+		// Start fails with err, bc only keeps the server usable until then
+		bc, _ = NewBroadcaster(opts.SendQueueSize, PolicyDropOldest)
+	}
+	switch opts.VerifyAddr {
+	case "", VerifyReject, VerifyFlag:
+	default:
+		if err == nil {
+			err = fmt.Errorf("unknown verify mode: %q", opts.VerifyAddr)
+		}
+	}
+	bc.metrics = mt
+	bc.log = logger
 	return &ConfigServer{
-		opts: opts,
-		srv: wsserver.NewWSServer(&wsserver.Options{
-			ListenAddr: opts.ListenAddr,
-			Path:       "/",
-		}),
+		opts:     opts,
+		err:      err,
+		src:      &configSource{},
+		adm:      newAdmission(opts),
 		store:    gostore.NewStore(),
+		bc:       bc,
+		metrics:  mt,
+		log:      logger,
+		dispatch: newDispatchWatch(),
+		gw: &gateway{
+			peers:    make(map[string]*gatewayPeer),
+			pending:  make(map[string]bool),
+			watchers: make(map[*gatewayConn]bool),
+		},
 		handlers: make([]Handler, 0),
 		timeout:  opts.Timeout,
 	}
@@ -43,61 +127,222 @@ func NewConfigServer(opts *Options) *ConfigServer {
 
 // Start starts the Config server
 func (s *ConfigServer) Start() error {
+	if s.err != nil {
+		s.log.Error("invalid options", Fields{"error": s.err})
+		return s.err
+	}
 
-	d, err := ioutil.ReadFile(s.opts.ConfigFile)
+	// the admin endpoints come up first so that /readyz can tell when the
+	// server is ready
+	if s.opts.AdminAddr != "" {
+		if err := s.startAdmin(); err != nil {
+			s.log.Error("admin listen error", Fields{"addr": s.opts.AdminAddr, "error": err})
+			return err
+		}
+	}
+
+	var err error
+	if s.opts.KeyringFile != "" {
+		s.keyring, err = LoadKeyring(s.opts.KeyringFile)
+		if err != nil {
+			s.log.Error("load keyring error", Fields{"file": s.opts.KeyringFile, "error": err})
+			return err
+		}
+	}
+
+	if s.opts.ACLFile != "" {
+		s.src.acl, err = LoadACL(s.opts.ACLFile)
+		if err != nil {
+			s.log.Error("load ACL error", Fields{"file": s.opts.ACLFile, "error": err})
+			return err
+		}
+	}
+
+	if s.opts.SigningKeyFile != "" {
+		s.src.key, err = LoadSigningKey(s.opts.SigningKeyFile)
+		if err != nil {
+			s.log.Error("load signing key error", Fields{"file": s.opts.SigningKeyFile, "error": err})
+			return err
+		}
+	}
+
+	// parse the config file, resolving the $secret references and
+	// decrypting the $enc values
+	config, err := loadConfigFile(s.opts.ConfigFile, s.keyring)
 	if err != nil {
-		log.Printf("Read config file error: %s", err.Error())
+		s.log.Error("load config error", Fields{"file": s.opts.ConfigFile, "error": err})
 		return err
 	}
-	//log.Printf("config file contents: \"%s\"", string(d))
-	//s.config = d
+	s.src.set(config)
 
-	// parse the config file
-	err = json.Unmarshal(d, &s.config)
-	if err != nil {
-		log.Printf("Unmarshal config error: %s", err.Error())
+	var tlsConfig *tls.Config
+	if s.opts.TLSCert != "" {
+		tlsConfig, err = LoadServerTLSConfig(s.opts.TLSCert, s.opts.TLSKey, s.opts.TLSClientCA, s.opts.RequireClientCert)
+		if err != nil {
+			s.log.Error("load TLS config error", Fields{"error": err})
+			return err
+		}
+	}
+	if err := s.startWS(tlsConfig); err != nil {
+		s.log.Error("listen error", Fields{"addr": s.opts.ListenAddr, "error": err})
 		return err
 	}
-	//log.Printf("cfg: %v", s.config)
 
 	s.store.Init()
 
-	ch := NewConnectHandler(s.store, &s.config, s.opts)
+	ch := newConnectHandler(s.store, s.src, s.opts, s.bc, s.metrics)
 	s.handlers = append(s.handlers, ch)
 
-	ph := NewPingHandler(s.store, s.opts)
+	ph := newPingHandler(s.store, s.opts, s.bc, s.metrics)
+	ph.OnPeerStateDidChange(ch.schedulePush)
+	ch.OnPeersDidChange(ph.SetPeers)
+	ch.OnPeerRegistered(ph.connected)
+	ch.OnPeersPushed(s.pushWatchers)
 	s.handlers = append(s.handlers, ph)
+	s.ping = ph
 
-	s.srv.OnMessage(s.onMessage)
-	s.srv.OnConnectionWillClose(s.onConnectionWillClose)
-	s.srv.Run()
-	return nil
+	if s.opts.HTTPAddr != "" {
+		if err := s.startGateway(); err != nil {
+			s.log.Error("gateway listen error", Fields{"addr": s.opts.HTTPAddr, "error": err})
+			return err
+		}
+	}
+	atomic.StoreInt32(&s.ready, 1)
+
+	return s.runWS()
 }
 
 // Stop stops the config server
 func (s *ConfigServer) Stop() {
-	s.srv.Stop()
+	atomic.StoreInt32(&s.ready, 0)
+	if s.admin != nil {
+		s.admin.Close()
+	}
+	s.stopGateway()
+	s.stopWS()
+	s.bc.Close()
 	s.store.Close()
 	for _, h := range s.handlers {
 		h.Close()
 	}
 }
 
+// Reload reads the config file again and pushes the new version to all the
+// registered peers and watch streams with config_changed
+func (s *ConfigServer) Reload() error {
+	config, err := loadConfigFile(s.opts.ConfigFile, s.keyring)
+	if err != nil {
+		s.log.Error("reload config error", Fields{"file": s.opts.ConfigFile, "error": err})
+		s.metrics.reloadFailure()
+		return err
+	}
+	version := s.src.set(config)
+	s.log.Info("config reloaded", Fields{"version": version})
+
+	conns := s.gatewayWatchers(false)
+	for _, addr := range peerAddrs(s.store) {
+		item, found, _ := s.store.Get(addr)
+		if found {
+			conns = append(conns, item.Value.(pubsub.Conn))
+		}
+	}
+	for _, c := range conns {
+		mesg := &Message{
+			OP:   OPConfigChanged,
+			Type: TypePush,
+		}
+		s.src.fill(mesg, connIdentity(s.store, c))
+		mesg.ID = fmt.Sprintf("config-%d", mesg.Version)
+		s.bc.Send(c, mesg)
+	}
+	return nil
+}
+
 // GetStore returns the in-memory k/v store
 func (s *ConfigServer) GetStore() gostore.Store {
 	return s.store
 }
 
 func (s *ConfigServer) onMessage(data []byte, c pubsub.Conn) {
-	//log.Printf("onMessage: %s", string(data))
+	s.dispatch.start(c)
+	defer s.dispatch.done(c)
+
+	// the websocket read limit stops larger frames before they are read,
+	// this catches the messages of the other transports
+	if len(data) > s.maxMessageSize() {
+		s.log.Warn("message too large", Fields{"conn_id": c.ID(), "size": len(data)})
+		resp := &Message{
+			OP:    OPError,
+			Type:  TypeResponse,
+			Error: ErrMessageTooLarge.Error(),
+		}
+		s.bc.SendAndClose(c, resp)
+		return
+	}
 
 	req := &Message{}
 	err := json.Unmarshal(data, req)
 	if err != nil {
-		log.Printf("onMessage parse error: %s", err.Error())
+		s.log.Warn("message parse error", Fields{"conn_id": c.ID(), "error": err})
+		resp := &Message{
+			OP:    OPError,
+			Type:  TypeResponse,
+			Error: ErrInvalidMessage.Error(),
+		}
+		s.bc.Send(c, resp)
+		return
+	}
+	s.log.Debug("message", Fields{"conn_id": c.ID(), "op": req.OP, "type": req.Type, "req_id": req.ID})
+	s.metrics.message(req.OP)
+
+	if err := s.adm.allow(c, req); err != nil {
+		s.log.Warn("message not admitted", Fields{"conn_id": c.ID(), "op": req.OP, "req_id": req.ID, "error": err})
+		resp := &Message{
+			OP:    req.OP,
+			Type:  TypeResponse,
+			ID:    req.ID,
+			Error: err.Error(),
+		}
+		if err == ErrTooManyConnections {
+			s.bc.SendAndClose(c, resp)
+		} else {
+			s.bc.Send(c, resp)
+		}
+		return
+	}
+
+	err = req.validate()
+	if err == nil && req.OP == OPConnect {
+		req.Addr, err = observeAddr(req.Addr, s.observedAddr(c))
+	}
+	if err != nil {
+		s.log.Warn("invalid request", Fields{"conn_id": c.ID(), "op": req.OP, "req_id": req.ID, "error": err})
+		resp := &Message{
+			OP:    req.OP,
+			Type:  TypeResponse,
+			ID:    req.ID,
+			Error: err.Error(),
+		}
+		s.bc.Send(c, resp)
+		return
+	}
+
+	if s.opts.Authenticator != nil && !s.authenticate(req, c) {
+		return
+	}
+
+	identity := connIdentity(s.store, c)
+	if !s.src.acl.Allow(identity, req.OP) {
+		s.log.Warn("request forbidden", Fields{"conn_id": c.ID(), "identity": identity, "op": req.OP, "req_id": req.ID})
+		resp := &Message{
+			OP:    req.OP,
+			Type:  TypeResponse,
+			ID:    req.ID,
+			Error: ErrForbidden.Error(),
+		}
+		s.bc.Send(c, resp)
 		return
 	}
-	log.Printf("operation: %s", req.OP)
 
 	// pass to all the handlers
 	for _, h := range s.handlers {
@@ -106,36 +351,125 @@ func (s *ConfigServer) onMessage(data []byte, c pubsub.Conn) {
 
 	if req.OP == OPGet {
 		resp := &Message{
-			OP:     OPGet,
+			OP:   OPGet,
+			Type: TypeResponse,
+			ID:   req.ID,
+		}
+		s.src.fill(resp, identity)
+		s.bc.Send(c, resp)
+	}
+
+	if req.OP == OPQueues {
+		resp := &Message{
+			OP:     OPQueues,
 			Type:   TypeResponse,
 			ID:     req.ID,
-			Config: s.config,
+			Queues: s.bc.Stats(),
 		}
-		s.send(c, resp)
+		s.bc.Send(c, resp)
 	}
 
 }
 
-func (s *ConfigServer) send(c pubsub.Conn, m *Message) {
-	b, err := json.Marshal(m)
-	if err != nil {
-		panic(err)
+// maxMessageSize returns the largest message accepted in bytes
+func (s *ConfigServer) maxMessageSize() int {
+	if s.opts.MaxMessageSize > 0 {
+		return s.opts.MaxMessageSize
+	}
+	return DefaultMaxMessageSize
+}
+
+// remoteIP returns the IP of the client of c, empty if unknown
+func (s *ConfigServer) remoteIP(c pubsub.Conn) string {
+	if addr := s.observedAddr(c); addr != nil {
+		return hostIP(addr)
+	}
+	return ""
+}
+
+// onConnect admits a new websocket connection and sets its identity if it
+// has a verified client certificate. A connection identified by its
+// certificate needs no token. A connection over the limits gets an error
+// and is closed.
+func (s *ConfigServer) onConnect(c *wsConn) error {
+	if err := s.adm.open(c, s.remoteIP(c), ""); err != nil {
+		s.log.Warn("connection not admitted", Fields{"conn_id": c.ID(), "remote": c.remote, "error": err})
+		resp := &Message{
+			OP:    OPError,
+			Type:  TypeResponse,
+			Error: err.Error(),
+		}
+		c.Send(resp.ToBytes())
+		return err
 	}
-	err = c.Send(b)
+	s.bc.Add(c)
+	if c.identity == "" {
+		s.log.Debug("connection opened", Fields{"conn_id": c.ID(), "remote": c.remote})
+		return nil
+	}
+	s.log.Info("connection identified by certificate", Fields{"conn_id": c.ID(), "identity": c.identity})
+	key := fmt.Sprintf("%d-identity", c.ID())
+	s.store.Put(&gostore.Item{
+		ID:    key,
+		Key:   key,
+		Value: c.identity,
+	}, 0)
+	return nil
+}
+
+// authenticate returns whether m may be processed. The first message of a
+// connection must carry a valid token, otherwise the connection is closed.
+// An auth op is answered here and (re)sets the identity of the connection.
+func (s *ConfigServer) authenticate(m *Message, c pubsub.Conn) bool {
+	key := fmt.Sprintf("%d-identity", c.ID())
+	if _, found, _ := s.store.Get(key); found && m.OP != OPAuth {
+		return true
+	}
+
+	identity, err := s.opts.Authenticator.Authenticate(m.Token)
 	if err != nil {
-		log.Printf("send error: %s", err.Error())
+		s.log.Warn("authentication failed", Fields{"conn_id": c.ID(), "op": m.OP, "req_id": m.ID, "error": err})
+		resp := &Message{
+			OP:    m.OP,
+			Type:  TypeResponse,
+			ID:    m.ID,
+			Error: ErrUnauthorized.Error(),
+		}
+		s.bc.SendAndClose(c, resp)
+		return false
+	}
+	s.log.Info("connection authenticated", Fields{"conn_id": c.ID(), "identity": identity})
+	s.store.Put(&gostore.Item{
+		ID:    key,
+		Key:   key,
+		Value: identity,
+	}, 0)
+
+	if m.OP == OPAuth {
+		resp := &Message{
+			OP:   OPAuth,
+			Type: TypeResponse,
+			ID:   m.ID,
+		}
+		s.bc.Send(c, resp)
+		return false
 	}
+	return true
 }
 
 func (s *ConfigServer) onConnectionWillClose(c pubsub.Conn) {
+	s.bc.Remove(c)
+	s.adm.release(c)
+	s.store.Del(fmt.Sprintf("%d-identity", c.ID()))
 	item, found, _ := s.store.Get(fmt.Sprintf("%d", c.ID()))
 	if found {
 		// remove connection from mem store
 		addr := item.Value.(string)
-		log.Printf("connectin closed for addr: %s", addr)
+		s.log.Info("connection closed", Fields{"conn_id": c.ID(), "addr": addr})
 		s.store.Del(fmt.Sprintf("%d", c.ID()))
 		s.store.Del(addr)
+		s.store.Del(fmt.Sprintf("%s-identity", addr))
 	} else {
-		log.Printf("connection %d not found in store", c.ID())
+		s.log.Debug("connection closed", Fields{"conn_id": c.ID()})
 	}
 }
@@ -2,7 +2,6 @@ package cfgsrv
 
 import (
 	"fmt"
-	"log"
 	"sync"
 	"time"
 
@@ -11,52 +10,206 @@ import (
 )
 
 type ConnectHandler struct {
-	store  gostore.Store
-	config *map[string]interface{}
-	opts   *Options
+	store gostore.Store
+	src   *configSource
+	opts  *Options
+	hb    heartbeat
+	bc    *Broadcaster
+	mt    *metrics
+	log   Logger
+
+	verifier    *addrVerifier
+	registerMtx sync.Mutex // one register at a time
 
 	reqID    int64
 	reqIDMtx sync.Mutex
+
+	onPeersChange    func(addrs []string)
+	onPeersPushed    func(m *Message)
+	onRegistered     func(addr string, c pubsub.Conn)
+	onPeersChangeMtx sync.Mutex
+
+	pushTimer    *time.Timer // pending coalesced peers_changed
+	closed       bool        // no push after Close
+	pushTimerMtx sync.Mutex
 }
 
+// NewConnectHandler creates a ConnectHandler that serves the config cfg
+// points to, for a server built on the handlers rather than a ConfigServer.
+// Its messages are sent from the handler, without send queues.
 func NewConnectHandler(store gostore.Store, cfg *map[string]interface{}, opts *Options) Handler {
+	src := &configSource{}
+	src.set(*cfg)
+	return newConnectHandler(store, src, opts, newDirectBroadcaster(), nil)
+}
+
+func newConnectHandler(store gostore.Store, src *configSource, opts *Options, bc *Broadcaster, mt *metrics) *ConnectHandler {
 	h := &ConnectHandler{
-		store:  store,
-		config: cfg,
-		opts:   opts,
+		store: store,
+		src:   src,
+		opts:  opts,
+		hb:    newHeartbeat(opts),
+		bc:    bc,
+		mt:    mt,
+		log:   loggerOf(opts),
+
+		verifier: newAddrVerifier(opts.VerifyTimeout),
 	}
 	h.store.OnListDidChange(h.onListDidChange)
 	return h
 }
 
 func (h *ConnectHandler) ProcessMessage(m *Message, c pubsub.Conn) {
+	switch m.OP {
+	case OPConnect:
+		h.connect(m, c)
+	case OPDisconnect:
+		h.disconnect(m, c)
+	case OPHealth:
+		h.health(m, c)
+	case OPPeers:
+		h.peers(m, c)
+	}
+}
 
-	if m.OP != OPConnect {
+func (h *ConnectHandler) connect(m *Message, c pubsub.Conn) {
+	if h.opts.VerifyAddr == "" {
+		h.register(m, c, false)
 		return
 	}
 
-	peers := make([]string, 0)
+	// only the IP the connection comes from is dialed, so a connect cannot
+	// point the server at a third party
+	remote, _ := remoteAddr(c)
+	if !observedHost(m.Addr, remote) {
+		h.log.Warn("addr not observed", Fields{"conn_id": c.ID(), "addr": m.Addr, "remote": remote})
+		h.unverified(m, c, ErrAddrNotObserved)
+		return
+	}
 
-	items, _, err := h.store.ListGet("peers")
-	//log.Printf("items: %v", items)
+	// check that the other peers can reach the announced addr, off the
+	// message dispatch of the connection
+	err := h.verifier.start(m.Addr, func(err error) {
+		if !h.bc.has(c) {
+			// closed while its addr was dialed
+			return
+		}
+		if err != nil {
+			h.log.Warn("addr unreachable", Fields{"conn_id": c.ID(), "addr": m.Addr, "error": err})
+			h.unverified(m, c, ErrUnreachable)
+			return
+		}
+		h.register(m, c, false)
+	})
 	if err != nil {
-		log.Printf("ListGet ERROR: %s", err.Error())
+		h.log.Warn("addr verification refused", Fields{"conn_id": c.ID(), "addr": m.Addr, "error": err})
+		h.sendError(m, c, err)
+	}
+}
+
+// unverified handles a connect whose addr failed verification with err.
+// VerifyReject refuses it and VerifyFlag registers it as unreachable.
+func (h *ConnectHandler) unverified(m *Message, c pubsub.Conn, err error) {
+	if h.opts.VerifyAddr == VerifyReject {
+		h.sendError(m, c, err)
 		return
 	}
-	if len(items) > 0 {
+	h.register(m, c, true)
+}
 
-		// broadcast
-		for _, item := range items {
-			peers = append(peers, item.Value.(string))
+// sendError sends the error response of the request m
+func (h *ConnectHandler) sendError(m *Message, c pubsub.Conn, err error) {
+	resp := &Message{
+		OP:    m.OP,
+		Type:  TypeResponse,
+		ID:    m.ID,
+		Error: err.Error(),
+	}
+	h.bc.Send(c, resp)
+}
+
+// register adds the addr of the connect m to the peer list and responds
+// with the list. The connects of several connections, and the verifications
+// finishing, run concurrently, so the registrations are serialized for the
+// list to hold each addr once and at most Options.MaxPeers.
+func (h *ConnectHandler) register(m *Message, c pubsub.Conn, unreachable bool) {
+	h.registerMtx.Lock()
+	defer h.registerMtx.Unlock()
+
+	// a newer connection announcing an addr that is already registered
+	// takes it over, the older connection is told why and closed. Only the
+	// identity that registered the addr may take it over.
+	identity := connIdentity(h.store, c)
+	item, found, _ := h.store.Get(m.Addr)
+	if found {
+		if old := item.Value.(pubsub.Conn); old.ID() != c.ID() {
+			if owner := peerIdentity(h.store, m.Addr); owner != identity {
+				h.log.Warn("addr takeover forbidden", Fields{"conn_id": c.ID(), "addr": m.Addr, "identity": identity, "owner": owner})
+				h.sendError(m, c, ErrForbidden)
+				return
+			}
+			h.takeover(m.Addr, old)
 		}
+	}
 
-		peers = append(peers, m.Addr)
+	items, _, err := h.store.ListGet("peers")
+	if err != nil {
+		h.log.Error("peer list error", Fields{"error": err})
+		return
+	}
 
-	} else {
+	// the peer list never contains the same addr twice
+	listed := false
+	peers := make([]string, 0)
+	for _, item := range items {
+		addr := item.Value.(string)
+		if addr == m.Addr {
+			listed = true
+		}
+		peers = append(peers, addr)
+	}
+	if !listed {
+		if h.opts.MaxPeers > 0 && len(items) >= h.opts.MaxPeers {
+			resp := &Message{
+				OP:    OPConnect,
+				Type:  TypeResponse,
+				ID:    m.ID,
+				Error: ErrTooManyPeers.Error(),
+			}
+			h.bc.Send(c, resp)
+			return
+		}
 		peers = append(peers, m.Addr)
 	}
 
 	// save connection in memory store
+	if unreachable {
+		h.store.Put(&gostore.Item{
+			ID:    fmt.Sprintf("%s-state", m.Addr),
+			Key:   fmt.Sprintf("%s-state", m.Addr),
+			Value: StateUnreachable,
+		}, 0)
+	} else {
+		h.store.Del(fmt.Sprintf("%s-state", m.Addr))
+	}
+	if m.Group != "" {
+		h.store.Put(&gostore.Item{
+			ID:    fmt.Sprintf("%s-group", m.Addr),
+			Key:   fmt.Sprintf("%s-group", m.Addr),
+			Value: m.Group,
+		}, 0)
+	} else {
+		h.store.Del(fmt.Sprintf("%s-group", m.Addr))
+	}
+	if identity != "" {
+		h.store.Put(&gostore.Item{
+			ID:    fmt.Sprintf("%s-identity", m.Addr),
+			Key:   fmt.Sprintf("%s-identity", m.Addr),
+			Value: identity,
+		}, 0)
+	} else {
+		h.store.Del(fmt.Sprintf("%s-identity", m.Addr))
+	}
 	h.store.Put(&gostore.Item{
 		ID:    m.Addr,
 		Key:   m.Addr,
@@ -67,32 +220,181 @@ func (h *ConnectHandler) ProcessMessage(m *Message, c pubsub.Conn) {
 		Key:   fmt.Sprintf("%d", c.ID()),
 		Value: m.Addr,
 	}, 0)
-	h.store.Put(&gostore.Item{
-		ID:    fmt.Sprintf("%s-ping", m.Addr),
-		Key:   fmt.Sprintf("%s-ping", m.Addr),
-		Value: m.Addr,
-	}, time.Duration(h.opts.Timeout)*time.Second)
+
+	// the verification may register the addr long after the connect went
+	// through the other handlers, so they are told here
+	h.onPeersChangeMtx.Lock()
+	f := h.onRegistered
+	h.onPeersChangeMtx.Unlock()
+	if f != nil {
+		f(m.Addr, c)
+	}
 
 	// send response
+	states := peerStates(h.store, peers)
+	peers = filterPeers(peers, states, m.Filter)
 	resp := &Message{
-		OP:     OPConnect,
-		Type:   TypeResponse,
-		ID:     m.ID,
-		Config: h.config,
-		Peers:  peers,
+		OP:        OPConnect,
+		Type:      TypeResponse,
+		ID:        m.ID,
+		Peers:     peers,
+		States:    filterStates(states, peers),
+		Timeout:   h.hb.timeout().String(),
+		Heartbeat: h.hb.advertise(),
 	}
-	c.Send(resp.ToBytes())
+	h.src.fill(resp, identity)
+	h.bc.Send(c, resp)
 
 	// add to peer list
-	h.store.ListPush("peers", &gostore.Item{
-		ID:    m.Addr,
-		Key:   "peers",
-		Value: m.Addr,
-	})
+	if !listed {
+		h.store.ListPush("peers", &gostore.Item{
+			ID:    m.Addr,
+			Key:   "peers",
+			Value: m.Addr,
+		})
+	}
 
 }
 
 func (h *ConnectHandler) Close() {
+	h.pushTimerMtx.Lock()
+	defer h.pushTimerMtx.Unlock()
+	h.closed = true
+	if h.pushTimer != nil {
+		h.pushTimer.Stop()
+		h.pushTimer = nil
+	}
+}
+
+// disconnect lists the peer of c as draining and removes it from the peer
+// list once the requested drain period is over
+func (h *ConnectHandler) disconnect(m *Message, c pubsub.Conn) {
+	resp := &Message{
+		OP:   OPDisconnect,
+		Type: TypeResponse,
+		ID:   m.ID,
+	}
+
+	item, found, _ := h.store.Get(fmt.Sprintf("%d", c.ID()))
+	if !found {
+		resp.Error = "not connected"
+		h.bc.Send(c, resp)
+		return
+	}
+	addr := item.Value.(string)
+
+	var drain time.Duration
+	if m.Drain != "" {
+		d, err := time.ParseDuration(m.Drain)
+		if err != nil || d < 0 {
+			resp.Error = fmt.Sprintf("invalid drain: %q", m.Drain)
+			h.bc.Send(c, resp)
+			return
+		}
+		drain = d
+	}
+	h.bc.Send(c, resp)
+
+	h.log.Info("peer disconnecting", Fields{"conn_id": c.ID(), "addr": addr, "drain": drain})
+	h.store.Put(&gostore.Item{
+		ID:    fmt.Sprintf("%s-state", addr),
+		Key:   fmt.Sprintf("%s-state", addr),
+		Value: StateDraining,
+	}, 0)
+	h.schedulePush()
+
+	time.AfterFunc(drain, func() {
+		// a connect during the drain period cancels the departure
+		item, found, _ := h.store.Get(fmt.Sprintf("%s-state", addr))
+		if found && item.Value.(string) == StateDraining {
+			removePeer(h.store, addr)
+		}
+	})
+}
+
+// health updates the health state of the peer of c and pushes it to all
+// the peers
+func (h *ConnectHandler) health(m *Message, c pubsub.Conn) {
+	resp := &Message{
+		OP:   OPHealth,
+		Type: TypeResponse,
+		ID:   m.ID,
+	}
+
+	item, found, _ := h.store.Get(fmt.Sprintf("%d", c.ID()))
+	if !found {
+		resp.Error = "not connected"
+		h.bc.Send(c, resp)
+		return
+	}
+	addr := item.Value.(string)
+
+	if !validHealthState(m.State) {
+		resp.Error = fmt.Sprintf("invalid state: %q", m.State)
+		h.bc.Send(c, resp)
+		return
+	}
+
+	key := fmt.Sprintf("%s-state", addr)
+	item, found, _ = h.store.Get(key)
+	if found && item.Value.(string) == StateDraining {
+		resp.Error = "peer is draining"
+		h.bc.Send(c, resp)
+		return
+	}
+	if found && item.Value.(string) == StateUnreachable {
+		// the flag is only cleared by a connect that passes verification
+		resp.Error = "peer is unreachable"
+		h.bc.Send(c, resp)
+		return
+	}
+	h.bc.Send(c, resp)
+
+	h.log.Info("peer health", Fields{"conn_id": c.ID(), "addr": addr, "state": m.State})
+	if m.State == StatePassing {
+		h.store.Del(key)
+	} else {
+		h.store.Put(&gostore.Item{
+			ID:    key,
+			Key:   key,
+			Value: m.State,
+		}, 0)
+	}
+	h.schedulePush()
+}
+
+// peers responds with the peer list filtered by the states in m.Filter
+func (h *ConnectHandler) peers(m *Message, c pubsub.Conn) {
+	peers := make([]string, 0)
+	items, _, _ := h.store.ListGet("peers")
+	for _, item := range items {
+		peers = append(peers, item.Value.(string))
+	}
+	states := peerStates(h.store, peers)
+	peers = filterPeers(peers, states, m.Filter)
+	resp := &Message{
+		OP:     OPPeers,
+		Type:   TypeResponse,
+		ID:     m.ID,
+		Peers:  peers,
+		States: filterStates(states, peers),
+	}
+	h.bc.Send(c, resp)
+}
+
+// takeover hands addr over to a newer connection. The old connection gets a
+// closing push with the reason and is closed.
+func (h *ConnectHandler) takeover(addr string, old pubsub.Conn) {
+	h.log.Info("addr taken over", Fields{"conn_id": old.ID(), "addr": addr})
+	h.mt.takeover()
+	h.store.Del(fmt.Sprintf("%d", old.ID()))
+	mesg := &Message{
+		OP:     OPClosing,
+		Type:   TypePush,
+		ID:     h.genReqID(),
+		Reason: fmt.Sprintf("addr %s taken over by a newer connection", addr),
+	}
+	h.bc.SendAndClose(old, mesg)
 }
 
 func (h *ConnectHandler) genReqID() string {
@@ -102,6 +404,34 @@ func (h *ConnectHandler) genReqID() string {
 	return fmt.Sprintf("%d", h.reqID)
 }
 
+// schedulePush pushes the peer list to all the peers. With a
+// Options.PeersChangedDelay the changes within the window are coalesced into
+// a single peers_changed carrying the final list. Nothing is pushed once the
+// handler is closed, pushTimerMtx is held while pushing so Close waits for
+// a push in progress.
+func (h *ConnectHandler) schedulePush() {
+	h.pushTimerMtx.Lock()
+	defer h.pushTimerMtx.Unlock()
+	if h.closed {
+		return
+	}
+	if h.opts.PeersChangedDelay <= 0 {
+		h.pushPeers()
+		return
+	}
+	if h.pushTimer != nil {
+		return
+	}
+	h.pushTimer = time.AfterFunc(h.opts.PeersChangedDelay, func() {
+		h.pushTimerMtx.Lock()
+		defer h.pushTimerMtx.Unlock()
+		h.pushTimer = nil
+		if !h.closed {
+			h.pushPeers()
+		}
+	})
+}
+
 func (h *ConnectHandler) pushPeers() {
 	items, found, _ := h.store.ListGet("peers")
 	if !found {
@@ -117,18 +447,63 @@ func (h *ConnectHandler) pushPeers() {
 		addr := item.Value.(string)
 		mesg.Peers = append(mesg.Peers, addr)
 	}
+	mesg.States = peerStates(h.store, mesg.Peers)
 
-	// get the pubsub.Conn for each address and send the message
+	// get the pubsub.Conn for each address and queue the message, which is
+	// serialized only once
+	conns := make([]pubsub.Conn, 0, len(mesg.Peers))
 	for _, peer := range mesg.Peers {
 		item, found, _ := h.store.Get(peer)
 		if found {
-			conn := item.Value.(pubsub.Conn)
-			conn.Send(mesg.ToBytes())
+			conns = append(conns, item.Value.(pubsub.Conn))
 		}
 	}
+	h.bc.Broadcast(conns, mesg)
+
+	h.onPeersChangeMtx.Lock()
+	f := h.onPeersPushed
+	h.onPeersChangeMtx.Unlock()
+	if f != nil {
+		f(mesg)
+	}
+}
+
+// OnPeersDidChange sets the callback called with the peer list every time
+// it changes
+func (h *ConnectHandler) OnPeersDidChange(f func(addrs []string)) {
+	h.onPeersChangeMtx.Lock()
+	defer h.onPeersChangeMtx.Unlock()
+	h.onPeersChange = f
+}
+
+// OnPeersPushed sets the callback called with every peers_changed pushed to
+// the peers
+func (h *ConnectHandler) OnPeersPushed(f func(m *Message)) {
+	h.onPeersChangeMtx.Lock()
+	defer h.onPeersChangeMtx.Unlock()
+	h.onPeersPushed = f
+}
+
+// OnPeerRegistered sets the callback called every time a connection
+// registers an addr, including a takeover of an addr already listed
+func (h *ConnectHandler) OnPeerRegistered(f func(addr string, c pubsub.Conn)) {
+	h.onPeersChangeMtx.Lock()
+	defer h.onPeersChangeMtx.Unlock()
+	h.onRegistered = f
 }
 
 func (h *ConnectHandler) onListDidChange(key string, items []*gostore.Item) {
-	log.Printf("onListDidChange: key: \"%s\" len: %d", key, len(items))
-	h.pushPeers()
+	h.log.Debug("peer list changed", Fields{"key": key, "peers": len(items)})
+	h.schedulePush()
+
+	h.onPeersChangeMtx.Lock()
+	f := h.onPeersChange
+	h.onPeersChangeMtx.Unlock()
+	if f != nil {
+		addrs := make([]string, 0, len(items))
+		for _, item := range items {
+			addrs = append(addrs, item.Value.(string))
+		}
+		f(addrs)
+	}
 }
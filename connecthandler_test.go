@@ -0,0 +1,183 @@
+package cfgsrv
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/tonjun/gostore"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ConnectHandler", func() {
+
+	var (
+		store gostore.Store
+		bc    *Broadcaster
+		h     *ConnectHandler
+		opts  *Options
+		conns []*testConn
+	)
+
+	// peersChanged returns the peers_changed pushes sent to c
+	peersChanged := func(c *testConn) func() []*Message {
+		return func() []*Message {
+			res := make([]*Message, 0)
+			for _, m := range c.messages() {
+				if m.OP == OPPeersChanged {
+					res = append(res, m)
+				}
+			}
+			return res
+		}
+	}
+
+	connect := func(c *testConn) {
+		h.ProcessMessage(&Message{
+			OP:   OPConnect,
+			Type: TypeRequest,
+			ID:   "connect",
+			Addr: fmt.Sprintf("10.0.0.%d:7070", c.id),
+		}, c)
+	}
+
+	BeforeEach(func() {
+		store = gostore.NewStore()
+		store.Init()
+		bc, _ = NewBroadcaster(0, "")
+		opts = &Options{
+			Timeout:           3,
+			PeersChangedDelay: 200 * time.Millisecond,
+			Logger:            NewJSONLogger(ioutil.Discard, LevelError),
+		}
+		src := &configSource{}
+		src.set(map[string]interface{}{})
+		h = newConnectHandler(store, src, opts, bc, nil)
+
+		conns = make([]*testConn, 0)
+		for i := 1; i <= 3; i++ {
+			c := &testConn{id: int64(i)}
+			bc.Add(c)
+			conns = append(conns, c)
+		}
+	})
+
+	AfterEach(func() {
+		h.Close()
+		bc.Close()
+		store.Close()
+	})
+
+	It("should coalesce the peer list changes within PeersChangedDelay", func() {
+		for _, c := range conns {
+			connect(c)
+		}
+		for _, c := range conns {
+			Eventually(peersChanged(c)).Should(HaveLen(1))
+			Consistently(peersChanged(c), 500*time.Millisecond).Should(HaveLen(1))
+			Expect(peersChanged(c)()[0].Peers).To(Equal([]string{
+				"10.0.0.1:7070",
+				"10.0.0.2:7070",
+				"10.0.0.3:7070",
+			}))
+		}
+	})
+
+	// listed returns the addrs of the peer list
+	listed := func() []string {
+		items, _, _ := store.ListGet("peers")
+		addrs := make([]string, 0, len(items))
+		for _, item := range items {
+			addrs = append(addrs, item.Value.(string))
+		}
+		return addrs
+	}
+
+	// connectAll connects the connections 1 to n at once, to addr or to an
+	// addr of their own if addr is ""
+	connectAll := func(n int, addr string) {
+		var wg sync.WaitGroup
+		for i := 1; i <= n; i++ {
+			c := &testConn{id: int64(100 + i)}
+			bc.Add(c)
+			a := addr
+			if a == "" {
+				a = fmt.Sprintf("10.0.1.%d:7070", i)
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				h.ProcessMessage(&Message{OP: OPConnect, Type: TypeRequest, ID: "connect", Addr: a}, c)
+			}()
+		}
+		wg.Wait()
+	}
+
+	It("should list an addr once when it is connected concurrently", func() {
+		connectAll(20, "10.0.0.9:7070")
+		Expect(listed()).To(Equal([]string{"10.0.0.9:7070"}))
+	})
+
+	It("should not exceed MaxPeers with concurrent connects", func() {
+		opts.MaxPeers = 5
+		connectAll(20, "")
+		Expect(listed()).To(HaveLen(5))
+	})
+
+	It("should not push after Close", func() {
+		for _, c := range conns {
+			connect(c)
+		}
+		h.Close()
+		h.schedulePush()
+		for _, c := range conns {
+			Consistently(peersChanged(c), 500*time.Millisecond).Should(BeEmpty())
+		}
+	})
+
+})
+
+var _ = Describe("NewConnectHandler and NewPingHandler", func() {
+
+	It("should serve a connect and ping its peer without a ConfigServer", func() {
+		store := gostore.NewStore()
+		store.Init()
+		defer store.Close()
+		cfg := map[string]interface{}{"feature1": true}
+		opts := &Options{
+			Timeout:      3,
+			PingInterval: time.Hour,
+			Logger:       NewJSONLogger(ioutil.Discard, LevelError),
+		}
+		ch := NewConnectHandler(store, &cfg, opts)
+		defer ch.Close()
+		ph := NewPingHandler(store, opts)
+		defer ph.Close()
+
+		c := &testConn{id: 1}
+		m := &Message{OP: OPConnect, Type: TypeRequest, ID: "c1", Addr: "10.0.0.1:7070"}
+		ch.ProcessMessage(m, c)
+		ph.ProcessMessage(m, c)
+		resp := c.messages()[0]
+		Expect(resp.OP).To(Equal(OPConnect))
+		Expect(resp.Peers).To(Equal([]string{"10.0.0.1:7070"}))
+		Expect(resp.Config).To(Equal(map[string]interface{}{"feature1": true}))
+
+		pinged := func() bool {
+			for _, m := range c.messages() {
+				if m.OP == OPPing {
+					return true
+				}
+			}
+			return false
+		}
+		for i := 0; i < pingSlots; i++ {
+			ph.(*PingHandler).onTick(time.Now())
+		}
+		Expect(pinged()).To(BeTrue())
+	})
+
+})
@@ -0,0 +1,218 @@
+package cfgsrv
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Liveness is the verdict of a FailureDetector about a peer
+type Liveness int
+
+const (
+	// Alive peers keep their place in the peer list
+	Alive Liveness = iota
+
+	// Suspect peers are listed with the suspect state
+	Suspect
+
+	// Dead peers are removed from the peer list
+	Dead
+)
+
+// StateSuspect marks a peer that the failure detector suspects to be down
+const StateSuspect = "suspect"
+
+// FailureDetector decides from the heartbeat history of a peer whether it
+// is still alive. Set Options.FailureDetector to replace the fixed Timeout
+// eviction.
+type FailureDetector interface {
+	// Heartbeat records a sign of life from addr at t
+	Heartbeat(addr string, t time.Time)
+
+	// Check returns the liveness of addr at t
+	Check(addr string, t time.Time) Liveness
+
+	// Forget drops the history of addr
+	Forget(addr string)
+}
+
+// ttlDetector is the default FailureDetector. A peer is dead once it has
+// been silent for longer than the timeout.
+type ttlDetector struct {
+	timeout time.Duration
+	last    map[string]time.Time
+	mtx     sync.Mutex
+}
+
+func newTTLDetector(timeout time.Duration) *ttlDetector {
+	return &ttlDetector{
+		timeout: timeout,
+		last:    make(map[string]time.Time),
+	}
+}
+
+// Heartbeat is the implementation of the FailureDetector interface
+func (d *ttlDetector) Heartbeat(addr string, t time.Time) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.last[addr] = t
+}
+
+// Check is the implementation of the FailureDetector interface
+func (d *ttlDetector) Check(addr string, t time.Time) Liveness {
+	if t.Before(d.Deadline(addr)) {
+		return Alive
+	}
+	return Dead
+}
+
+// Forget is the implementation of the FailureDetector interface
+func (d *ttlDetector) Forget(addr string) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	delete(d.last, addr)
+}
+
+// Deadline returns when addr will be dead unless it heartbeats. Unknown
+// peers never die.
+func (d *ttlDetector) Deadline(addr string) time.Time {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	last, found := d.last[addr]
+	if !found {
+		return time.Now().Add(d.timeout)
+	}
+	return last.Add(d.timeout)
+}
+
+// PhiAccrualDetector is a FailureDetector that computes phi, the suspicion
+// level of a peer, from the distribution of its heartbeat inter-arrival
+// times. A phi of 1 means a 10% chance that marking the peer as down is a
+// mistake, 2 means 1%, 3 means 0.1% and so on. NewPhiAccrualDetector sets
+// all the fields from the heartbeat interval, a struct literal sets its own.
+type PhiAccrualDetector struct {
+	SuspectPhi      float64       // Phi at which a peer is suspect
+	DeadPhi         float64       // Phi at which a peer is dead
+	MinStdDev       time.Duration // Lower bound of the inter-arrival deviation
+	AcceptablePause time.Duration // Pause tolerated on top of the mean interval
+	FirstInterval   time.Duration // Interval assumed before the first sample
+	Window          int           // Number of inter-arrival samples kept
+
+	peers map[string]*arrivals
+	mtx   sync.Mutex
+}
+
+// NewPhiAccrualDetector creates a PhiAccrualDetector for peers that
+// heartbeat every interval
+func NewPhiAccrualDetector(interval time.Duration) *PhiAccrualDetector {
+	return &PhiAccrualDetector{
+		SuspectPhi:      5,
+		DeadPhi:         10,
+		MinStdDev:       interval / 10,
+		AcceptablePause: interval,
+		FirstInterval:   interval,
+		Window:          100,
+		peers:           make(map[string]*arrivals),
+	}
+}
+
+// Heartbeat is the implementation of the FailureDetector interface
+func (d *PhiAccrualDetector) Heartbeat(addr string, t time.Time) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if d.peers == nil {
+		d.peers = make(map[string]*arrivals)
+	}
+	a, found := d.peers[addr]
+	if !found {
+		// seed the history with the expected interval so that a single
+		// heartbeat gives a usable distribution
+		a = &arrivals{last: t}
+		a.add(d.FirstInterval, d.Window)
+		d.peers[addr] = a
+		return
+	}
+	if t.After(a.last) {
+		a.add(t.Sub(a.last), d.Window)
+		a.last = t
+	}
+}
+
+// Check is the implementation of the FailureDetector interface
+func (d *PhiAccrualDetector) Check(addr string, t time.Time) Liveness {
+	phi := d.Phi(addr, t)
+	switch {
+	case phi >= d.DeadPhi:
+		return Dead
+	case phi >= d.SuspectPhi:
+		return Suspect
+	}
+	return Alive
+}
+
+// Forget is the implementation of the FailureDetector interface
+func (d *PhiAccrualDetector) Forget(addr string) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	delete(d.peers, addr)
+}
+
+// Phi returns the suspicion level of addr at t. Unknown peers have a phi of 0.
+func (d *PhiAccrualDetector) Phi(addr string, t time.Time) float64 {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	a, found := d.peers[addr]
+	if !found {
+		return 0
+	}
+	mean, stdDev := a.meanStdDev()
+	if stdDev < float64(d.MinStdDev) {
+		stdDev = float64(d.MinStdDev)
+	}
+	mean += float64(d.AcceptablePause)
+	return phi(float64(t.Sub(a.last)), mean, stdDev)
+}
+
+// phi uses the logistic approximation of the normal distribution CDF
+func phi(elapsed, mean, stdDev float64) float64 {
+	y := (elapsed - mean) / stdDev
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if elapsed > mean {
+		return -math.Log10(e / (1 + e))
+	}
+	return -math.Log10(1 - 1/(1+e))
+}
+
+// arrivals is the heartbeat inter-arrival history of a single peer
+type arrivals struct {
+	last      time.Time
+	intervals []float64
+	sum       float64
+	sumSq     float64
+}
+
+func (a *arrivals) add(d time.Duration, window int) {
+	v := float64(d)
+	if window > 0 && len(a.intervals) >= window {
+		old := a.intervals[0]
+		a.intervals = a.intervals[1:]
+		a.sum -= old
+		a.sumSq -= old * old
+	}
+	a.intervals = append(a.intervals, v)
+	a.sum += v
+	a.sumSq += v * v
+}
+
+func (a *arrivals) meanStdDev() (float64, float64) {
+	n := float64(len(a.intervals))
+	mean := a.sum / n
+	variance := a.sumSq/n - mean*mean
+	if variance < 0 {
+		variance = 0
+	}
+	return mean, math.Sqrt(variance)
+}
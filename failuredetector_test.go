@@ -0,0 +1,127 @@
+package cfgsrv
+
+import (
+	"math"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Failure detectors", func() {
+
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	Describe("phi", func() {
+
+		It("should be log10(2) at the mean", func() {
+			Expect(phi(1000, 1000, 100)).To(BeNumerically("~", math.Log10(2), 0.001))
+		})
+
+		It("should grow with the time elapsed", func() {
+			prev := phi(0, 1000, 100)
+			for _, elapsed := range []float64{500, 1000, 1100, 1200, 1500, 2000} {
+				p := phi(elapsed, 1000, 100)
+				Expect(p).To(BeNumerically(">", prev))
+				prev = p
+			}
+		})
+
+		It("should match the normal distribution tail", func() {
+			// two standard deviations above the mean: P = 0.0228
+			Expect(phi(1200, 1000, 100)).To(BeNumerically("~", -math.Log10(0.0228), 0.05))
+		})
+
+	})
+
+	Describe("arrivals", func() {
+
+		It("should keep the mean and deviation of the window", func() {
+			a := &arrivals{}
+			for _, d := range []time.Duration{5, 1, 3, 1, 3} {
+				a.add(d*time.Second, 4)
+			}
+			Expect(a.intervals).To(HaveLen(4))
+			mean, stdDev := a.meanStdDev()
+			Expect(mean).To(BeNumerically("~", float64(2*time.Second), 1))
+			Expect(stdDev).To(BeNumerically("~", float64(time.Second), 1))
+		})
+
+	})
+
+	Describe("PhiAccrualDetector", func() {
+
+		var d *PhiAccrualDetector
+
+		BeforeEach(func() {
+			d = NewPhiAccrualDetector(time.Second)
+			for i := 0; i < 10; i++ {
+				d.Heartbeat("10.0.0.1:7070", t0.Add(time.Duration(i)*time.Second))
+			}
+		})
+
+		last := t0.Add(9 * time.Second)
+
+		It("should keep a peer alive while it heartbeats on time", func() {
+			Expect(d.Check("10.0.0.1:7070", last.Add(time.Second))).To(Equal(Alive))
+			Expect(d.Check("10.0.0.1:7070", last.Add(1500*time.Millisecond))).To(Equal(Alive))
+		})
+
+		It("should suspect a peer and then declare it dead", func() {
+			Expect(d.Check("10.0.0.1:7070", last.Add(2500*time.Millisecond))).To(Equal(Suspect))
+			Expect(d.Check("10.0.0.1:7070", last.Add(3*time.Second))).To(Equal(Dead))
+		})
+
+		It("should ignore a heartbeat older than the last one", func() {
+			d.Heartbeat("10.0.0.1:7070", t0)
+			Expect(d.Check("10.0.0.1:7070", last.Add(3*time.Second))).To(Equal(Dead))
+		})
+
+		It("should start a new peer with the expected interval", func() {
+			d.Heartbeat("10.0.0.2:7070", last)
+			Expect(d.Check("10.0.0.2:7070", last.Add(time.Second))).To(Equal(Alive))
+			Expect(d.Check("10.0.0.2:7070", last.Add(3*time.Second))).To(Equal(Dead))
+		})
+
+		It("should work as a struct literal", func() {
+			d := &PhiAccrualDetector{
+				SuspectPhi:      5,
+				DeadPhi:         10,
+				MinStdDev:       100 * time.Millisecond,
+				AcceptablePause: time.Second,
+				FirstInterval:   time.Second,
+			}
+			d.Forget("10.0.0.1:7070")
+			Expect(d.Phi("10.0.0.1:7070", t0)).To(BeZero())
+			d.Heartbeat("10.0.0.1:7070", t0)
+			Expect(d.Check("10.0.0.1:7070", t0.Add(time.Second))).To(Equal(Alive))
+			Expect(d.Check("10.0.0.1:7070", t0.Add(time.Hour))).To(Equal(Dead))
+		})
+
+		It("should consider unknown and forgotten peers alive", func() {
+			Expect(d.Phi("10.0.0.3:7070", last)).To(BeZero())
+			Expect(d.Check("10.0.0.3:7070", last.Add(time.Hour))).To(Equal(Alive))
+
+			d.Forget("10.0.0.1:7070")
+			Expect(d.Phi("10.0.0.1:7070", last.Add(time.Hour))).To(BeZero())
+			Expect(d.Check("10.0.0.1:7070", last.Add(time.Hour))).To(Equal(Alive))
+		})
+
+	})
+
+	Describe("ttlDetector", func() {
+
+		It("should declare a peer dead after the timeout", func() {
+			d := newTTLDetector(3 * time.Second)
+			d.Heartbeat("10.0.0.1:7070", t0)
+			Expect(d.Deadline("10.0.0.1:7070")).To(Equal(t0.Add(3 * time.Second)))
+			Expect(d.Check("10.0.0.1:7070", t0.Add(2*time.Second))).To(Equal(Alive))
+			Expect(d.Check("10.0.0.1:7070", t0.Add(3*time.Second))).To(Equal(Dead))
+
+			d.Forget("10.0.0.1:7070")
+			Expect(d.Check("10.0.0.1:7070", t0.Add(time.Hour))).To(Equal(Alive))
+		})
+
+	})
+
+})
@@ -0,0 +1,674 @@
+package cfgsrv
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tonjun/gostore"
+	"github.com/tonjun/pubsub"
+)
+
+// DefaultPeerTTL is the registration TTL of PUT /v1/peers/{addr} without a
+// ttl parameter
+const DefaultPeerTTL = 30 * time.Second
+
+// maxPeerTTLFactor caps the registration TTL of PUT /v1/peers/{addr} at
+// this many times the heartbeat timeout of the websocket peers
+const maxPeerTTLFactor = 10
+
+// gatewayTimeout is how long the gateway waits for the response of a request
+const gatewayTimeout = 5 * time.Second
+
+var (
+	// errGatewayTimeout is the error of a request the handlers did not answer
+	errGatewayTimeout = errors.New("no response")
+
+	// errGatewayClosed is the error of a request on a closed gateway
+	// connection
+	errGatewayClosed = errors.New("connection closed")
+
+	// errNotRegistered is the error of a heartbeat for a registration that
+	// expired or was taken over in the meantime
+	errNotRegistered = errors.New("peer not registered")
+
+	// errRegistering is the error of a PUT for an addr whose registration
+	// by another request is in progress
+	errRegistering = errors.New("registration in progress")
+)
+
+// gatewayConnID numbers the gateway connections. They count down from -1 so
+// they never collide with the websocket connections.
+var gatewayConnID int64
+
+// gateway is the REST/HTTP gateway. Every HTTP request is processed by the
+// same onMessage pipeline and handlers as the websocket messages, through a
+// gatewayConn that captures the response.
+type gateway struct {
+	srv      *http.Server
+	peers    map[string]*gatewayPeer // addr to peer registered with PUT
+	pending  map[string]bool         // addrs whose first PUT is in progress
+	watchers map[*gatewayConn]bool   // GET /v1/watch streams to whether they see the peers
+	mtx      sync.Mutex
+}
+
+// gatewayPeer is a peer registered with PUT /v1/peers/{addr}. It stays in
+// the peer list until its TTL runs out without another PUT.
+type gatewayPeer struct {
+	conn     *gatewayConn
+	identity string
+	timer    *time.Timer
+}
+
+// gatewayPeers is the body of GET /v1/peers
+type gatewayPeers struct {
+	Peers  []string          `json:"peers"`
+	States map[string]string `json:"states,omitempty"`
+}
+
+// gatewayRegistration is the body of PUT /v1/peers/{addr}
+type gatewayRegistration struct {
+	Addr string `json:"addr"`
+	TTL  string `json:"ttl"`
+}
+
+// gatewayError is the body of a failed gateway request
+type gatewayError struct {
+	Error string `json:"error"`
+}
+
+// gatewayConn is the pubsub.Conn of a gateway request, peer or watch
+// stream. It delivers the responses to the waiting request, answers the
+// server pings while its peer is registered and passes the pushes to its
+// stream while watching.
+type gatewayConn struct {
+	id         int64
+	remote     net.Addr
+	addr       string // registered addr, if any
+	s          *ConfigServer
+	resp       chan *Message
+	reqMtx     sync.Mutex // one request at a time
+	registered int32      // atomic, 1 while the conn is a registered peer
+	watching   int32      // atomic, 1 while the pushes go to events
+	closed     int32      // atomic, 1 once closed
+	events     chan []byte
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+func newGatewayConn(s *ConfigServer, r *http.Request) *gatewayConn {
+	c := &gatewayConn{
+		id:     atomic.AddInt64(&gatewayConnID, -1),
+		s:      s,
+		resp:   make(chan *Message, 1),
+		events: make(chan []byte, 16),
+		done:   make(chan struct{}),
+	}
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		c.remote = addr
+	}
+	return c
+}
+
+// ID is the implementation of pubsub.Conn
+func (c *gatewayConn) ID() int64 {
+	return c.id
+}
+
+// Send is the implementation of pubsub.Conn
+func (c *gatewayConn) Send(data []byte) error {
+	m := &Message{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return err
+	}
+	switch {
+	case m.Type == TypeResponse:
+		// keep the config bytes as sent, they may be signed
+		var raw struct {
+			Config json.RawMessage `json:"config"`
+		}
+		if json.Unmarshal(data, &raw) == nil && raw.Config != nil {
+			m.Config = raw.Config
+		}
+		select {
+		case c.resp <- m:
+		default:
+		}
+
+	case m.OP == OPPing && m.Type == TypeRequest && atomic.LoadInt32(&c.registered) == 1:
+		pong := &Message{
+			OP:   OPPong,
+			Type: TypeResponse,
+			ID:   m.ID,
+		}
+		go func() {
+			if atomic.LoadInt32(&c.closed) == 0 {
+				c.s.onMessage(pong.ToBytes(), c)
+			}
+		}()
+
+	case m.Type == TypePush && atomic.LoadInt32(&c.watching) == 1:
+		// blocks the send queue of c until the stream takes the push
+		select {
+		case c.events <- data:
+		case <-c.done:
+		}
+	}
+	return nil
+}
+
+// RemoteAddr returns the address of the HTTP client
+func (c *gatewayConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// Close releases the connection like a closed websocket
+func (c *gatewayConn) Close() error {
+	c.closeOnce.Do(func() {
+		atomic.StoreInt32(&c.registered, 0)
+		atomic.StoreInt32(&c.watching, 0)
+		atomic.StoreInt32(&c.closed, 1)
+		close(c.done)
+		c.s.forgetGatewayConn(c)
+		c.s.onConnectionWillClose(c)
+	})
+	return nil
+}
+
+// request processes m and returns its response
+func (c *gatewayConn) request(m *Message) (*Message, error) {
+	c.reqMtx.Lock()
+	defer c.reqMtx.Unlock()
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return nil, errGatewayClosed
+	}
+
+	// forget a response that came too late for the previous request
+	select {
+	case <-c.resp:
+	default:
+	}
+
+	c.s.onMessage(m.ToBytes(), c)
+	timeout := time.After(gatewayTimeout)
+	for {
+		select {
+		case resp := <-c.resp:
+			if resp.ID == m.ID || resp.OP == OPError {
+				return resp, nil
+			}
+		case <-timeout:
+			return nil, errGatewayTimeout
+		}
+	}
+}
+
+// startGateway serves the REST gateway on Options.HTTPAddr, over TLS when
+// Options.TLSCert is set
+func (s *ConfigServer) startGateway() error {
+	ln, err := net.Listen("tcp", s.opts.HTTPAddr)
+	if err != nil {
+		return err
+	}
+	if s.opts.TLSCert != "" {
+		cfg, err := LoadServerTLSConfig(s.opts.TLSCert, s.opts.TLSKey, s.opts.TLSClientCA, s.opts.RequireClientCert)
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		ln = tls.NewListener(ln, cfg)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/config", s.serveConfig)
+	mux.HandleFunc("/v1/peers", s.servePeers)
+	mux.HandleFunc("/v1/peers/", s.servePeer)
+	mux.HandleFunc("/v1/watch", s.serveWatch)
+	s.gw.srv = newHTTPServer(mux)
+	go func() {
+		if err := s.gw.srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			s.log.Error("gateway server error", Fields{"error": err})
+		}
+	}()
+	return nil
+}
+
+// stopGateway stops the gateway and forgets its peers
+func (s *ConfigServer) stopGateway() {
+	if s.gw.srv != nil {
+		s.gw.srv.Close()
+	}
+	s.gw.mtx.Lock()
+	defer s.gw.mtx.Unlock()
+	for addr, p := range s.gw.peers {
+		p.timer.Stop()
+		delete(s.gw.peers, addr)
+	}
+}
+
+// serveConfig serves GET /v1/config. A path parameter selects a subtree by
+// its dotted path. With an index parameter the request waits, up to the
+// wait parameter, for a config version over index. The request is
+// authenticated, admitted and checked against the ACL before it waits.
+func (s *ConfigServer) serveConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	c, ok := s.gatewayOpen(w, r)
+	if !ok {
+		return
+	}
+	defer c.Close()
+
+	// long poll until the version is over index
+	q := r.URL.Query()
+	if v := q.Get("index"); v != "" {
+		index, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid index: %q", v))
+			return
+		}
+		wait := defaultWait
+		if v := q.Get("wait"); v != "" {
+			wait, err = time.ParseDuration(v)
+			if err != nil || wait <= 0 {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid wait: %q", v))
+				return
+			}
+		}
+		if wait > maxWait {
+			wait = maxWait
+		}
+		if identity := connIdentity(s.store, c); !s.src.acl.Allow(identity, OPGet) {
+			s.log.Warn("request forbidden", Fields{"conn_id": c.ID(), "identity": identity, "op": OPGet})
+			writeError(w, http.StatusForbidden, ErrForbidden.Error())
+			return
+		}
+		s.src.wait(r.Context(), index, wait)
+	}
+
+	resp, ok := s.gatewayRequest(w, c, &Message{OP: OPGet})
+	if !ok {
+		return
+	}
+	raw, err := json.Marshal(resp.Config)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.Header().Set("X-Config-Index", fmt.Sprintf("%d", resp.Version))
+
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		// the whole config is sent as signed
+		if resp.Signature != "" {
+			w.Header().Set("X-Config-Version", fmt.Sprintf("%d", resp.Version))
+			w.Header().Set("X-Config-Signature", resp.Signature)
+		}
+		writeETag(w, r, raw)
+		return
+	}
+
+	var v interface{} = map[string]interface{}{}
+	json.Unmarshal(raw, &v)
+	for _, key := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			v = nil
+			break
+		}
+		if v, ok = m[key]; !ok {
+			break
+		}
+	}
+	if v == nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("path not found: %q", path))
+		return
+	}
+	b, _ := json.Marshal(v)
+	writeETag(w, r, b)
+}
+
+// servePeers serves GET /v1/peers. Repeated filter parameters select the
+// peers by state.
+func (s *ConfigServer) servePeers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	resp, ok := s.gatewayDo(w, r, &Message{
+		OP:     OPPeers,
+		Filter: r.URL.Query()["filter"],
+	})
+	if !ok {
+		return
+	}
+	writeBody(w, http.StatusOK, &gatewayPeers{
+		Peers:  resp.Peers,
+		States: resp.States,
+	})
+}
+
+// servePeer serves PUT /v1/peers/{addr}. The first PUT registers addr like
+// a connect, the next ones are heartbeats that extend the registration by
+// the ttl parameter.
+func (s *ConfigServer) servePeer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	ttl := DefaultPeerTTL
+	if v := r.URL.Query().Get("ttl"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid ttl: %q", v))
+			return
+		}
+		ttl = d
+	}
+	if max := s.maxPeerTTL(); ttl > max {
+		ttl = max
+	}
+
+	identity, err := s.gatewayIdentity(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	c := newGatewayConn(s, r)
+	addr, err := normalizeAddr(strings.TrimPrefix(r.URL.Path, "/v1/peers/"))
+	if err == nil {
+		addr, err = observeAddr(addr, c.remote)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// a single request at a time registers an addr, the others heartbeat
+	// the registration or wait for it
+	s.gw.mtx.Lock()
+	p, found := s.gw.peers[addr]
+	pending := !found && s.gw.pending[addr]
+	if !found && !pending {
+		s.gw.pending[addr] = true
+	}
+	s.gw.mtx.Unlock()
+
+	if pending {
+		writeError(w, http.StatusConflict, errRegistering.Error())
+		return
+	}
+	if found {
+		if p.identity != identity {
+			writeError(w, http.StatusForbidden, ErrForbidden.Error())
+			return
+		}
+		s.heartbeatGatewayPeer(w, addr, p, ttl)
+		return
+	}
+
+	defer func() {
+		s.gw.mtx.Lock()
+		delete(s.gw.pending, addr)
+		s.gw.mtx.Unlock()
+	}()
+	if !s.openGatewayConn(w, c, identity) {
+		return
+	}
+	resp, err := c.request(&Message{
+		OP:    OPConnect,
+		Type:  TypeRequest,
+		ID:    "connect",
+		Addr:  addr,
+		Group: r.URL.Query().Get("group"),
+	})
+	if err != nil || resp.Error != "" {
+		c.Close()
+		writeResponseError(w, resp, err)
+		return
+	}
+
+	p = &gatewayPeer{
+		conn:     c,
+		identity: identity,
+	}
+	p.timer = time.AfterFunc(ttl, func() { s.expireGatewayPeer(addr, p) })
+	c.addr = addr
+	atomic.StoreInt32(&c.registered, 1)
+	s.gw.mtx.Lock()
+	s.gw.peers[addr] = p
+	delete(s.gw.pending, addr)
+	s.gw.mtx.Unlock()
+
+	s.log.Info("gateway peer registered", Fields{"conn_id": c.ID(), "addr": addr, "ttl": ttl})
+	writeBody(w, http.StatusOK, &gatewayRegistration{Addr: addr, TTL: ttl.String()})
+}
+
+// heartbeatGatewayPeer extends the registration of p by ttl. A registration
+// that expired or was taken over while the heartbeat was processed gets a
+// 404, the next PUT registers the addr again.
+func (s *ConfigServer) heartbeatGatewayPeer(w http.ResponseWriter, addr string, p *gatewayPeer, ttl time.Duration) {
+	resp, err := p.conn.request(&Message{
+		OP:   OPPing,
+		Type: TypeRequest,
+		ID:   "heartbeat",
+	})
+	if err == errGatewayClosed || atomic.LoadInt32(&p.conn.closed) == 1 {
+		writeError(w, http.StatusNotFound, errNotRegistered.Error())
+		return
+	}
+	if err != nil || resp.Error != "" {
+		writeResponseError(w, resp, err)
+		return
+	}
+
+	s.gw.mtx.Lock()
+	current := s.gw.peers[addr] == p
+	if current {
+		p.timer.Reset(ttl)
+	}
+	s.gw.mtx.Unlock()
+	if !current {
+		writeError(w, http.StatusNotFound, errNotRegistered.Error())
+		return
+	}
+	writeBody(w, http.StatusOK, &gatewayRegistration{Addr: addr, TTL: ttl.String()})
+}
+
+// maxPeerTTL returns the longest registration TTL of the gateway peers
+func (s *ConfigServer) maxPeerTTL() time.Duration {
+	return maxPeerTTLFactor * newHeartbeat(s.opts).timeout()
+}
+
+// expireGatewayPeer removes a gateway peer whose TTL ran out
+func (s *ConfigServer) expireGatewayPeer(addr string, p *gatewayPeer) {
+	s.gw.mtx.Lock()
+	if s.gw.peers[addr] != p {
+		s.gw.mtx.Unlock()
+		return
+	}
+	delete(s.gw.peers, addr)
+	s.gw.mtx.Unlock()
+
+	s.log.Info("gateway peer expired", Fields{"conn_id": p.conn.ID(), "addr": addr})
+
+	// the addr may have been taken over by a websocket connection
+	item, found, _ := s.store.Get(addr)
+	if found && item.Value.(pubsub.Conn).ID() == p.conn.ID() {
+		removePeer(s.store, addr)
+	}
+	p.conn.Close()
+}
+
+// forgetGatewayConn drops the registration or the watch of c, if any, when
+// it is closed, for example after a takeover
+func (s *ConfigServer) forgetGatewayConn(c *gatewayConn) {
+	s.gw.mtx.Lock()
+	defer s.gw.mtx.Unlock()
+	delete(s.gw.watchers, c)
+	if c.addr == "" {
+		return
+	}
+	if p, found := s.gw.peers[c.addr]; found && p.conn == c {
+		p.timer.Stop()
+		delete(s.gw.peers, c.addr)
+	}
+}
+
+// gatewayDo processes m for an HTTP request on a connection of its own and
+// returns the response. Errors are written to w.
+func (s *ConfigServer) gatewayDo(w http.ResponseWriter, r *http.Request, m *Message) (*Message, bool) {
+	c, ok := s.gatewayOpen(w, r)
+	if !ok {
+		return nil, false
+	}
+	defer c.Close()
+	return s.gatewayRequest(w, c, m)
+}
+
+// gatewayOpen authenticates an HTTP request and opens its connection. The
+// caller closes it. Errors are written to w.
+func (s *ConfigServer) gatewayOpen(w http.ResponseWriter, r *http.Request) (*gatewayConn, bool) {
+	identity, err := s.gatewayIdentity(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return nil, false
+	}
+
+	c := newGatewayConn(s, r)
+	if !s.openGatewayConn(w, c, identity) {
+		return nil, false
+	}
+	return c, true
+}
+
+// gatewayRequest processes m on c and returns the response. Errors are
+// written to w.
+func (s *ConfigServer) gatewayRequest(w http.ResponseWriter, c *gatewayConn, m *Message) (*Message, bool) {
+	m.Type = TypeRequest
+	m.ID = m.OP
+	resp, err := c.request(m)
+	if err != nil || resp.Error != "" {
+		writeResponseError(w, resp, err)
+		return nil, false
+	}
+	return resp, true
+}
+
+// openGatewayConn admits c like a new websocket connection and sets its
+// identity. The requests of an identity, or of a remote IP without one, share
+// their message rate. Errors are written to w.
+func (s *ConfigServer) openGatewayConn(w http.ResponseWriter, c *gatewayConn, identity string) bool {
+	ip := s.remoteIP(c)
+	client := ""
+	switch {
+	case identity != "":
+		client = "identity:" + identity
+	case ip != "":
+		client = "ip:" + ip
+	}
+	if err := s.adm.open(c, ip, client); err != nil {
+		s.log.Warn("gateway request not admitted", Fields{"conn_id": c.ID(), "remote": c.remote, "error": err})
+		writeError(w, http.StatusTooManyRequests, err.Error())
+		return false
+	}
+	s.bc.Add(c)
+	if identity != "" {
+		key := fmt.Sprintf("%d-identity", c.ID())
+		s.store.Put(&gostore.Item{
+			ID:    key,
+			Key:   key,
+			Value: identity,
+		}, 0)
+	}
+	return true
+}
+
+// gatewayIdentity returns the identity of an HTTP request, from its client
+// certificate or from its bearer token
+func (s *ConfigServer) gatewayIdentity(r *http.Request) (string, error) {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		identity := certIdentity
+		if s.opts.TLSIdentity != nil {
+			identity = s.opts.TLSIdentity
+		}
+		if id := identity(r.TLS.PeerCertificates[0]); id != "" {
+			return id, nil
+		}
+	}
+	if s.opts.Authenticator == nil {
+		return "", nil
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	identity, err := s.opts.Authenticator.Authenticate(token)
+	if err != nil {
+		s.log.Warn("gateway authentication failed", Fields{"remote": r.RemoteAddr, "error": err})
+		return "", ErrUnauthorized
+	}
+	return identity, nil
+}
+
+// writeETag writes body with its ETag, or 304 if the client has it already
+func writeETag(w http.ResponseWriter, r *http.Request, body []byte) {
+	sum := sha256.Sum256(body)
+	etag := fmt.Sprintf(`"%s"`, hex.EncodeToString(sum[:8]))
+	w.Header().Set("ETag", etag)
+	for _, tag := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if strings.TrimSpace(tag) == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+func writeBody(w http.ResponseWriter, code int, v interface{}) {
+	b, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+func writeError(w http.ResponseWriter, code int, err string) {
+	writeBody(w, code, &gatewayError{Error: err})
+}
+
+// writeResponseError writes the error of a gateway request with the HTTP
+// status matching it
+func writeResponseError(w http.ResponseWriter, resp *Message, err error) {
+	if err != nil {
+		writeError(w, http.StatusGatewayTimeout, err.Error())
+		return
+	}
+	code := http.StatusBadRequest
+	switch resp.Error {
+	case ErrUnauthorized.Error():
+		code = http.StatusUnauthorized
+	case ErrForbidden.Error():
+		code = http.StatusForbidden
+	case ErrTooManyConnections.Error(), ErrRateLimited.Error():
+		code = http.StatusTooManyRequests
+	case ErrTooManyPeers.Error():
+		code = http.StatusServiceUnavailable
+	case ErrMessageTooLarge.Error():
+		code = http.StatusRequestEntityTooLarge
+	}
+	writeError(w, code, resp.Error)
+}
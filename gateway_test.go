@@ -0,0 +1,199 @@
+package cfgsrv
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("HTTP gateway", func() {
+
+	var (
+		dir      string
+		httpAddr string
+		wsAddr   string
+		server   *ConfigServer
+	)
+
+	// do sends an HTTP request with token and returns the status and body
+	do := func(method, path, token string) (int, string) {
+		req, err := http.NewRequest(method, fmt.Sprintf("http://%s%s", httpAddr, path), nil)
+		Expect(err).To(BeNil())
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	peers := func() string {
+		_, body := do("GET", "/v1/peers", "token-a")
+		return body
+	}
+
+	start := func(opts *Options) {
+		httpAddr = freeAddr()
+		opts.HTTPAddr = httpAddr
+		opts.Timeout = 1
+		opts.Authenticator = NewStaticTokenAuth(map[string]string{
+			"token-a": "service-a",
+			"token-b": "service-b",
+		})
+		server, wsAddr = startServer(dir, opts)
+		Eventually(func() error {
+			_, err := http.Get(fmt.Sprintf("http://%s/v1/config", httpAddr))
+			return err
+		}).Should(BeNil())
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "cfgsrv-gateway")
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		server.Stop()
+		os.RemoveAll(dir)
+	})
+
+	Describe("peer registrations", func() {
+
+		BeforeEach(func() {
+			start(&Options{})
+		})
+
+		It("should remove a peer once its ttl runs out", func() {
+			code, _ := do("PUT", "/v1/peers/127.0.0.1:7272?ttl=300ms", "token-a")
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(peers()).To(ContainSubstring("127.0.0.1:7272"))
+			Eventually(peers, 2*time.Second).ShouldNot(ContainSubstring("127.0.0.1:7272"))
+
+			// the next PUT registers it again
+			code, _ = do("PUT", "/v1/peers/127.0.0.1:7272?ttl=300ms", "token-a")
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(peers()).To(ContainSubstring("127.0.0.1:7272"))
+		})
+
+		It("should extend the registration on every heartbeat", func() {
+			code, _ := do("PUT", "/v1/peers/127.0.0.1:7272?ttl=500ms", "token-a")
+			Expect(code).To(Equal(http.StatusOK))
+			for i := 0; i < 5; i++ {
+				time.Sleep(200 * time.Millisecond)
+				code, body := do("PUT", "/v1/peers/127.0.0.1:7272?ttl=500ms", "token-a")
+				Expect(code).To(Equal(http.StatusOK))
+				Expect(body).To(Equal(`{"addr":"127.0.0.1:7272","ttl":"500ms"}`))
+			}
+			Expect(peers()).To(ContainSubstring("127.0.0.1:7272"))
+			Eventually(peers, 2*time.Second).ShouldNot(ContainSubstring("127.0.0.1:7272"))
+		})
+
+		It("should not let another identity heartbeat a peer", func() {
+			code, _ := do("PUT", "/v1/peers/127.0.0.1:7272?ttl=10s", "token-a")
+			Expect(code).To(Equal(http.StatusOK))
+			code, body := do("PUT", "/v1/peers/127.0.0.1:7272?ttl=10s", "token-b")
+			Expect(code).To(Equal(http.StatusForbidden))
+			Expect(body).To(ContainSubstring(ErrForbidden.Error()))
+		})
+
+		It("should not let another identity take over an addr", func() {
+			conn := dialWS(wsAddr)
+			defer conn.Close()
+			sendWS(conn, &Message{OP: OPAuth, Type: TypeRequest, ID: "a1", Token: "token-a"})
+			Expect(readOP(conn, OPAuth).Error).To(Equal(""))
+			sendWS(conn, &Message{OP: OPConnect, Type: TypeRequest, ID: "c1", Addr: "127.0.0.1:7272"})
+			Expect(readOP(conn, OPConnect).Error).To(Equal(""))
+
+			code, body := do("PUT", "/v1/peers/127.0.0.1:7272?ttl=10s", "token-b")
+			Expect(code).To(Equal(http.StatusForbidden))
+			Expect(body).To(ContainSubstring(ErrForbidden.Error()))
+
+			other := dialWS(wsAddr)
+			defer other.Close()
+			sendWS(other, &Message{OP: OPAuth, Type: TypeRequest, ID: "a1", Token: "token-b"})
+			Expect(readOP(other, OPAuth).Error).To(Equal(""))
+			sendWS(other, &Message{OP: OPConnect, Type: TypeRequest, ID: "c1", Addr: "127.0.0.1:7272"})
+			Expect(readOP(other, OPConnect).Error).To(Equal(ErrForbidden.Error()))
+
+			// the identity that registered it may
+			code, _ = do("PUT", "/v1/peers/127.0.0.1:7272?ttl=10s", "token-a")
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(readOP(conn, OPClosing).Reason).To(ContainSubstring("taken over"))
+		})
+
+		It("should cap the ttl", func() {
+			code, body := do("PUT", "/v1/peers/127.0.0.1:7272?ttl=1h", "token-a")
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(body).To(Equal(fmt.Sprintf(`{"addr":"127.0.0.1:7272","ttl":"%s"}`, server.maxPeerTTL())))
+			Expect(server.maxPeerTTL()).To(Equal(10 * time.Second))
+		})
+
+	})
+
+	Describe("long polls", func() {
+
+		BeforeEach(func() {
+			start(&Options{
+				// only service-a may get the config
+				ACLFile: writeTemp(dir, "acl.json", `{
+					"identities": {"service-a": {"ops": ["get", "peers"], "paths": ["*"]}},
+					"default": {"ops": [], "paths": []}
+				}`),
+			})
+		})
+
+		It("should refuse a forbidden or unauthenticated request before it waits", func() {
+			path := fmt.Sprintf("/v1/config?index=%d&wait=5s", server.src.current())
+			begin := time.Now()
+			code, _ := do("GET", path, "token-b")
+			Expect(code).To(Equal(http.StatusForbidden))
+			code, _ = do("GET", path, "")
+			Expect(code).To(Equal(http.StatusUnauthorized))
+			Expect(time.Since(begin)).To(BeNumerically("<", time.Second))
+		})
+
+		It("should answer a waiting request when the config is reloaded", func() {
+			version := server.src.current()
+			index := make(chan string, 1)
+			go func() {
+				defer GinkgoRecover()
+				req, _ := http.NewRequest("GET", fmt.Sprintf("http://%s/v1/config?index=%d&wait=10s", httpAddr, version), nil)
+				req.Header.Set("Authorization", "Bearer token-a")
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).To(BeNil())
+				resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				index <- resp.Header.Get("X-Config-Index")
+			}()
+
+			Consistently(index, 300*time.Millisecond).ShouldNot(Receive())
+			Expect(server.Reload()).To(Succeed())
+			Eventually(index, 2*time.Second).Should(Receive(Equal(strconv.FormatInt(server.src.current(), 10))))
+			Expect(server.src.current()).To(BeNumerically(">", version))
+		})
+
+	})
+
+	It("should share the message rate of the requests of an identity", func() {
+		start(&Options{MessageRate: 1, MessageBurst: 1})
+		code, _ := do("GET", "/v1/config", "token-a")
+		Expect(code).To(Equal(http.StatusOK))
+		code, body := do("GET", "/v1/config", "token-a")
+		Expect(code).To(Equal(http.StatusTooManyRequests))
+		Expect(body).To(ContainSubstring(ErrRateLimited.Error()))
+
+		// another identity has a bucket of its own
+		code, _ = do("GET", "/v1/config", "token-b")
+		Expect(code).To(Equal(http.StatusOK))
+	})
+
+})
@@ -1,6 +1,8 @@
 package cfgsrv
 
 import (
+	"net"
+
 	"github.com/tonjun/pubsub"
 )
 
@@ -8,3 +10,25 @@ type Handler interface {
 	ProcessMessage(m *Message, c pubsub.Conn)
 	Close()
 }
+
+// closeConn closes c from the server side if the underlying connection
+// supports it
+func closeConn(c pubsub.Conn) {
+	switch cc := c.(type) {
+	case interface{ Close() error }:
+		cc.Close()
+	case interface{ Close() }:
+		cc.Close()
+	}
+}
+
+// remoteAddr returns the remote address of c if the underlying connection
+// exposes it
+func remoteAddr(c pubsub.Conn) (net.Addr, bool) {
+	if ra, ok := c.(interface{ RemoteAddr() net.Addr }); ok {
+		if addr := ra.RemoteAddr(); addr != nil {
+			return addr, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,124 @@
+package cfgsrv
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tonjun/pubsub"
+)
+
+// DefaultStallTimeout is how long a message may be processed before
+// /healthz fails when Options.StallTimeout is not set
+const DefaultStallTimeout = 10 * time.Second
+
+// dispatchWatch tracks the messages being processed to tell whether the
+// message dispatch is making progress
+type dispatchWatch struct {
+	busy map[int64]time.Time // connection ID to start of the message being processed
+	mtx  sync.Mutex
+}
+
+func newDispatchWatch() *dispatchWatch {
+	return &dispatchWatch{
+		busy: make(map[int64]time.Time),
+	}
+}
+
+// start marks the beginning of a message of c
+func (w *dispatchWatch) start(c pubsub.Conn) {
+	w.mtx.Lock()
+	w.busy[c.ID()] = time.Now()
+	w.mtx.Unlock()
+}
+
+// done marks the end of the message of c
+func (w *dispatchWatch) done(c pubsub.Conn) {
+	w.mtx.Lock()
+	delete(w.busy, c.ID())
+	w.mtx.Unlock()
+}
+
+// oldest returns how long the oldest message in process has been running
+func (w *dispatchWatch) oldest(now time.Time) time.Duration {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	var d time.Duration
+	for _, t := range w.busy {
+		if now.Sub(t) > d {
+			d = now.Sub(t)
+		}
+	}
+	return d
+}
+
+// healthStatus is the body of /healthz and /readyz
+type healthStatus struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// serveHealthz reports whether the ping loop and the message dispatch are
+// making progress
+func (s *ConfigServer) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	checks := map[string]string{
+		"ping_loop": "ok",
+		"dispatch":  "ok",
+	}
+
+	// s.ping is set before ready
+	if atomic.LoadInt32(&s.ready) == 0 {
+		checks["ping_loop"] = "not started"
+	} else if d, stalled := s.ping.stalled(now); stalled {
+		checks["ping_loop"] = fmt.Sprintf("no tick for %s", d)
+	}
+
+	limit := s.opts.StallTimeout
+	if limit <= 0 {
+		limit = DefaultStallTimeout
+	}
+	if d := s.dispatch.oldest(now); d > limit {
+		checks["dispatch"] = fmt.Sprintf("message in process for %s", d)
+	}
+
+	writeHealth(w, checks)
+}
+
+// serveReadyz reports whether the config is loaded and the store is
+// initialized
+func (s *ConfigServer) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{
+		"config": "ok",
+		"store":  "ok",
+	}
+	if s.src.current() == 0 {
+		checks["config"] = "not loaded"
+	}
+	if atomic.LoadInt32(&s.ready) == 0 {
+		checks["store"] = "not initialized"
+	}
+	writeHealth(w, checks)
+}
+
+// writeHealth responds with 200 if every check is ok, 503 otherwise
+func writeHealth(w http.ResponseWriter, checks map[string]string) {
+	status := &healthStatus{
+		Status: "ok",
+		Checks: checks,
+	}
+	code := http.StatusOK
+	for _, c := range checks {
+		if c != "ok" {
+			status.Status = "fail"
+			code = http.StatusServiceUnavailable
+		}
+	}
+	b, _ := json.Marshal(status)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+}
@@ -0,0 +1,90 @@
+package cfgsrv
+
+import (
+	"math/rand"
+	"time"
+)
+
+// pingSlots is the number of buckets the peers are spread over. Every tick
+// pings the peers of one bucket so that the pings of a round are spread
+// across the interval.
+const pingSlots = 10
+
+// minPingInterval is the shortest ping interval, a zero Options.Timeout
+// would otherwise spin the ping loop
+const minPingInterval = 100 * time.Millisecond
+
+// Heartbeat is the ping policy advertised to the peers in the connect response
+type Heartbeat struct {
+	Interval string `json:"interval"`
+	Missed   int    `json:"missed"`
+	Jitter   string `json:"jitter,omitempty"`
+}
+
+// heartbeat is the ping policy derived from the Options
+type heartbeat struct {
+	interval time.Duration
+	missed   int
+	jitter   time.Duration
+}
+
+// newHeartbeat returns the ping policy of opts. The interval defaults to half
+// of Options.Timeout and a peer is evicted after two missed pongs, which keeps
+// the eviction timeout at Options.Timeout. The interval is never shorter
+// than minPingInterval.
+func newHeartbeat(opts *Options) heartbeat {
+	hb := heartbeat{
+		interval: opts.PingInterval,
+		missed:   opts.MissedPings,
+		jitter:   opts.PingJitter,
+	}
+	if hb.interval <= 0 {
+		hb.interval = time.Duration(opts.Timeout) * time.Second / 2
+	}
+	if hb.interval < minPingInterval {
+		hb.interval = minPingInterval
+	}
+	if hb.missed <= 0 {
+		hb.missed = 2
+	}
+	if hb.jitter < 0 {
+		hb.jitter = 0
+	}
+	return hb
+}
+
+// timeout returns how long a peer may stay silent before it is evicted
+func (hb heartbeat) timeout() time.Duration {
+	return hb.interval*time.Duration(hb.missed) + hb.jitter
+}
+
+// slot returns the share of the interval of a single ping bucket
+func (hb heartbeat) slot() time.Duration {
+	t := hb.interval / pingSlots
+	if t < minPingInterval/pingSlots {
+		t = minPingInterval / pingSlots
+	}
+	return t
+}
+
+// tick returns the delay until the next bucket is pinged, including its
+// share of the random jitter
+func (hb heartbeat) tick() time.Duration {
+	t := hb.slot()
+	if j := hb.jitter / pingSlots; j > 0 {
+		t += time.Duration(rand.Int63n(int64(j)))
+	}
+	return t
+}
+
+// advertise returns the policy as sent to the peers
+func (hb heartbeat) advertise() *Heartbeat {
+	a := &Heartbeat{
+		Interval: hb.interval.String(),
+		Missed:   hb.missed,
+	}
+	if hb.jitter > 0 {
+		a.Jitter = hb.jitter.String()
+	}
+	return a
+}
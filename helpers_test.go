@@ -0,0 +1,134 @@
+package cfgsrv
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	. "github.com/onsi/gomega"
+)
+
+func freeAddr() string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+// writeTemp writes data to name in dir and returns its path
+func writeTemp(dir, name, data string) string {
+	path := filepath.Join(dir, name)
+	Expect(ioutil.WriteFile(path, []byte(data), 0600)).To(Succeed())
+	return path
+}
+
+// startServer starts a ConfigServer on a free address with a config file in
+// dir. opts may set anything else.
+func startServer(dir string, opts *Options) (*ConfigServer, string) {
+	opts.ListenAddr = freeAddr()
+	if opts.ConfigFile == "" {
+		opts.ConfigFile = writeTemp(dir, "config.json", `{"feature1":{"enable":true}}`)
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = 3
+	}
+	if opts.Logger == nil {
+		opts.Logger = NewJSONLogger(ioutil.Discard, LevelError)
+	}
+	server := NewConfigServer(opts)
+	go server.Start()
+	return server, opts.ListenAddr
+}
+
+// dialWS opens a websocket connection to the server at addr once it
+// accepts connections
+func dialWS(addr string) *websocket.Conn {
+	var conn *websocket.Conn
+	Eventually(func() error {
+		var err error
+		conn, _, err = websocket.DefaultDialer.Dial("ws://"+addr, nil)
+		return err
+	}).Should(BeNil())
+	return conn
+}
+
+// sendWS sends m on conn
+func sendWS(conn *websocket.Conn, m *Message) {
+	Expect(conn.WriteMessage(websocket.TextMessage, m.ToBytes())).To(Succeed())
+}
+
+// readOP reads from conn until a message with op arrives and returns it.
+// The server pings are answered on the way.
+func readOP(conn *websocket.Conn, op string) *Message {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, data, err := conn.ReadMessage()
+		Expect(err).To(BeNil())
+		m := &Message{}
+		Expect(json.Unmarshal(data, m)).To(Succeed())
+		if m.OP == op {
+			return m
+		}
+		if m.OP == OPPing && m.Type == TypeRequest {
+			sendWS(conn, &Message{OP: OPPong, Type: TypeResponse, ID: m.ID})
+		}
+	}
+}
+
+// testConn is a pubsub.Conn that keeps what is sent to it
+type testConn struct {
+	id     int64
+	remote net.Addr
+	sent   [][]byte
+	closed bool
+	mtx    sync.Mutex
+}
+
+func (c *testConn) ID() int64 {
+	return c.id
+}
+
+func (c *testConn) Send(b []byte) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.sent = append(c.sent, b)
+	return nil
+}
+
+func (c *testConn) Close() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *testConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// messages returns the messages sent to c so far
+func (c *testConn) messages() []*Message {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	res := make([]*Message, 0, len(c.sent))
+	for _, b := range c.sent {
+		m := &Message{}
+		Expect(json.Unmarshal(b, m)).To(Succeed())
+		res = append(res, m)
+	}
+	return res
+}
+
+func (c *testConn) isClosed() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.closed
+}
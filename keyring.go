@@ -0,0 +1,166 @@
+package cfgsrv
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// envelopeVersion prefixes every encrypted value
+const envelopeVersion = "v1"
+
+// Keyring holds the AES-256 keys used to encrypt config values. Values are
+// encrypted with the primary key, and decrypted with the key whose ID is in
+// their envelope, so older keys can be kept around while rotating.
+//
+//	{
+//	  "primary": "k2",
+//	  "keys": {
+//	    "k1": "<base64 32 bytes>",
+//	    "k2": "<base64 32 bytes>"
+//	  }
+//	}
+type Keyring struct {
+	Primary string            `json:"primary"`
+	Keys    map[string]string `json:"keys"`
+}
+
+// LoadKeyring reads a Keyring from a JSON file
+func LoadKeyring(path string) (*Keyring, error) {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	k := &Keyring{}
+	if err := json.Unmarshal(d, k); err != nil {
+		return nil, fmt.Errorf("parse keyring %s: %s", path, err.Error())
+	}
+	if k.Keys == nil {
+		k.Keys = make(map[string]string)
+	}
+	return k, nil
+}
+
+// Save writes the keyring to a file readable by the owner only
+func (k *Keyring) Save(path string) error {
+	d, err := json.MarshalIndent(k, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(d, '\n'), 0600)
+}
+
+// AddKey generates a new key with the given ID and makes it the primary key
+func (k *Keyring) AddKey(id string) error {
+	if id == "" || strings.Contains(id, ":") {
+		return fmt.Errorf("invalid key ID: %q", id)
+	}
+	if _, found := k.Keys[id]; found {
+		return fmt.Errorf("key %s already exists", id)
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	if k.Keys == nil {
+		k.Keys = make(map[string]string)
+	}
+	k.Keys[id] = base64.StdEncoding.EncodeToString(key)
+	k.Primary = id
+	return nil
+}
+
+// Encrypt seals plaintext with AES-GCM under the primary key and returns
+// the envelope v1:<key ID>:<base64 nonce and ciphertext>
+func (k *Keyring) Encrypt(plaintext []byte) (string, error) {
+	aead, err := k.aead(k.Primary)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	header := envelopeVersion + ":" + k.Primary
+	sealed := aead.Seal(nonce, nonce, plaintext, []byte(header))
+	return header + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens an envelope made by Encrypt
+func (k *Keyring) Decrypt(envelope string) ([]byte, error) {
+	parts := strings.SplitN(envelope, ":", 3)
+	if len(parts) != 3 || parts[0] != envelopeVersion {
+		return nil, errors.New("invalid envelope")
+	}
+	aead, err := k.aead(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, errors.New("invalid envelope")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	header := parts[0] + ":" + parts[1]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(header))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt with key %s: %s", parts[1], err.Error())
+	}
+	return plaintext, nil
+}
+
+func (k *Keyring) aead(id string) (cipher.AEAD, error) {
+	encoded, found := k.Keys[id]
+	if !found {
+		return nil, fmt.Errorf("unknown key: %q", id)
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("key %s is not a base64 AES-256 key", id)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// decryptValues replaces the {"$enc": envelope} values in v with the Secret
+// they decrypt to
+func decryptValues(v interface{}, k *Keyring) (interface{}, error) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if envelope, ok := t["$enc"].(string); ok && len(t) == 1 {
+			if k == nil {
+				return nil, errors.New("encrypted value without a keyring")
+			}
+			plaintext, err := k.Decrypt(envelope)
+			if err != nil {
+				return nil, err
+			}
+			return Secret(plaintext), nil
+		}
+		for key, sub := range t {
+			r, err := decryptValues(sub, k)
+			if err != nil {
+				return nil, err
+			}
+			t[key] = r
+		}
+	case []interface{}:
+		for i, sub := range t {
+			r, err := decryptValues(sub, k)
+			if err != nil {
+				return nil, err
+			}
+			t[i] = r
+		}
+	}
+	return v, nil
+}
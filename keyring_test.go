@@ -0,0 +1,146 @@
+package cfgsrv
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Keyring", func() {
+
+	var k *Keyring
+
+	BeforeEach(func() {
+		k = &Keyring{}
+		Expect(k.AddKey("k1")).To(Succeed())
+	})
+
+	It("should decrypt what it encrypts", func() {
+		envelope, err := k.Encrypt([]byte("s3cr3t"))
+		Expect(err).To(BeNil())
+		Expect(envelope).To(HavePrefix("v1:k1:"))
+		Expect(envelope).NotTo(ContainSubstring("s3cr3t"))
+
+		plaintext, err := k.Decrypt(envelope)
+		Expect(err).To(BeNil())
+		Expect(string(plaintext)).To(Equal("s3cr3t"))
+
+		// a fresh nonce every time
+		again, _ := k.Encrypt([]byte("s3cr3t"))
+		Expect(again).NotTo(Equal(envelope))
+	})
+
+	It("should encrypt with the new key and still decrypt with the old ones after a rotation", func() {
+		old, err := k.Encrypt([]byte("old"))
+		Expect(err).To(BeNil())
+
+		Expect(k.AddKey("k2")).To(Succeed())
+		Expect(k.Primary).To(Equal("k2"))
+		envelope, err := k.Encrypt([]byte("new"))
+		Expect(err).To(BeNil())
+		Expect(envelope).To(HavePrefix("v1:k2:"))
+
+		plaintext, err := k.Decrypt(old)
+		Expect(err).To(BeNil())
+		Expect(string(plaintext)).To(Equal("old"))
+
+		// once the old key is removed its values no longer decrypt
+		delete(k.Keys, "k1")
+		_, err = k.Decrypt(old)
+		Expect(err).NotTo(BeNil())
+		plaintext, err = k.Decrypt(envelope)
+		Expect(err).To(BeNil())
+		Expect(string(plaintext)).To(Equal("new"))
+	})
+
+	It("should refuse a key ID that exists or is invalid", func() {
+		Expect(k.AddKey("k1")).NotTo(Succeed())
+		Expect(k.AddKey("")).NotTo(Succeed())
+		Expect(k.AddKey("k:2")).NotTo(Succeed())
+	})
+
+	It("should reject tampered envelopes", func() {
+		envelope, err := k.Encrypt([]byte("s3cr3t"))
+		Expect(err).To(BeNil())
+		parts := strings.SplitN(envelope, ":", 3)
+		sealed, err := base64.StdEncoding.DecodeString(parts[2])
+		Expect(err).To(BeNil())
+
+		// a flipped ciphertext bit
+		flipped := append([]byte{}, sealed...)
+		flipped[len(flipped)-1] ^= 1
+		_, err = k.Decrypt(parts[0] + ":" + parts[1] + ":" + base64.StdEncoding.EncodeToString(flipped))
+		Expect(err).NotTo(BeNil())
+
+		// a truncated ciphertext
+		_, err = k.Decrypt(parts[0] + ":" + parts[1] + ":" + base64.StdEncoding.EncodeToString(sealed[:8]))
+		Expect(err).NotTo(BeNil())
+
+		// the key ID is authenticated, another key with the same bytes
+		// does not open it
+		k.Keys["k2"] = k.Keys["k1"]
+		_, err = k.Decrypt(parts[0] + ":k2:" + parts[2])
+		Expect(err).NotTo(BeNil())
+
+		for _, bad := range []string{"", "v1:k1", "v2:k1:" + parts[2], "v1:k9:" + parts[2], "v1:k1:!!!"} {
+			_, err = k.Decrypt(bad)
+			Expect(err).NotTo(BeNil())
+		}
+	})
+
+	It("should survive a save and load", func() {
+		dir, err := ioutil.TempDir("", "cfgsrv-keyring")
+		Expect(err).To(BeNil())
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "keyring.json")
+		Expect(k.Save(path)).To(Succeed())
+
+		info, err := os.Stat(path)
+		Expect(err).To(BeNil())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+
+		envelope, _ := k.Encrypt([]byte("s3cr3t"))
+		loaded, err := LoadKeyring(path)
+		Expect(err).To(BeNil())
+		plaintext, err := loaded.Decrypt(envelope)
+		Expect(err).To(BeNil())
+		Expect(string(plaintext)).To(Equal("s3cr3t"))
+	})
+
+	Describe("decryptValues", func() {
+
+		It("should replace the $enc values with secrets", func() {
+			envelope, _ := k.Encrypt([]byte("s3cr3t"))
+			config := map[string]interface{}{
+				"db":   map[string]interface{}{"pass": map[string]interface{}{"$enc": envelope}},
+				"list": []interface{}{map[string]interface{}{"$enc": envelope}},
+			}
+			_, err := decryptValues(config, k)
+			Expect(err).To(BeNil())
+			Expect(config["db"].(map[string]interface{})["pass"]).To(Equal(Secret("s3cr3t")))
+			Expect(config["list"].([]interface{})[0]).To(Equal(Secret("s3cr3t")))
+		})
+
+		It("should fail without a keyring", func() {
+			envelope, _ := k.Encrypt([]byte("s3cr3t"))
+			_, err := decryptValues(map[string]interface{}{"pass": map[string]interface{}{"$enc": envelope}}, nil)
+			Expect(err).NotTo(BeNil())
+		})
+
+		It("should refuse an $enc value as the config root", func() {
+			dir, err := ioutil.TempDir("", "cfgsrv-keyring")
+			Expect(err).To(BeNil())
+			defer os.RemoveAll(dir)
+			envelope, _ := k.Encrypt([]byte("s3cr3t"))
+			_, err = loadConfigFile(writeTemp(dir, "config.json", `{"$enc": "`+envelope+`"}`), k)
+			Expect(err).NotTo(BeNil())
+		})
+
+	})
+
+})
@@ -0,0 +1,139 @@
+package cfgsrv
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Logger is the leveled, structured logger of the config server. See
+// Options.Logger.
+type Logger interface {
+	Debug(msg string, fields Fields)
+	Info(msg string, fields Fields)
+	Warn(msg string, fields Fields)
+	Error(msg string, fields Fields)
+}
+
+// Fields are the key/values logged with a message, like conn_id, addr, op
+// and req_id
+type Fields map[string]interface{}
+
+// Level is the severity of a log message
+type Level int
+
+const (
+	LevelDebug Level = iota // per message and per ping details
+	LevelInfo               // connections, registrations and reloads
+	LevelWarn               // rejected requests and misbehaving clients
+	LevelError              // failures of the server itself
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the level named s
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level: %q", s)
+}
+
+// defaultLogger is used when Options.Logger is not set
+var defaultLogger Logger = NewJSONLogger(os.Stderr, LevelInfo)
+
+// loggerOf returns the logger of opts
+func loggerOf(opts *Options) Logger {
+	if opts == nil || opts.Logger == nil {
+		return defaultLogger
+	}
+	return opts.Logger
+}
+
+// JSONLogger writes one JSON object per line with the time, level, message
+// and fields of every message at or above its level
+type JSONLogger struct {
+	w     io.Writer
+	level Level
+	mtx   sync.Mutex
+}
+
+// NewJSONLogger creates a JSONLogger writing to w
+func NewJSONLogger(w io.Writer, level Level) *JSONLogger {
+	return &JSONLogger{
+		w:     w,
+		level: level,
+	}
+}
+
+// Debug logs msg at LevelDebug
+func (l *JSONLogger) Debug(msg string, fields Fields) { l.write(LevelDebug, msg, fields) }
+
+// Info logs msg at LevelInfo
+func (l *JSONLogger) Info(msg string, fields Fields) { l.write(LevelInfo, msg, fields) }
+
+// Warn logs msg at LevelWarn
+func (l *JSONLogger) Warn(msg string, fields Fields) { l.write(LevelWarn, msg, fields) }
+
+// Error logs msg at LevelError
+func (l *JSONLogger) Error(msg string, fields Fields) { l.write(LevelError, msg, fields) }
+
+func (l *JSONLogger) write(level Level, msg string, fields Fields) {
+	if level < l.level {
+		return
+	}
+
+	// time, level and msg come first, then the fields in key order
+	var b strings.Builder
+	b.WriteString(`{"time":`)
+	writeJSON(&b, time.Now().UTC().Format(time.RFC3339Nano))
+	b.WriteString(`,"level":`)
+	writeJSON(&b, level.String())
+	b.WriteString(`,"msg":`)
+	writeJSON(&b, msg)
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b.WriteByte(',')
+		writeJSON(&b, k)
+		b.WriteByte(':')
+		v := fields[k]
+		switch vv := v.(type) {
+		case error:
+			v = vv.Error()
+		case fmt.Stringer:
+			v = vv.String()
+		}
+		writeJSON(&b, v)
+	}
+	b.WriteString("}\n")
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	io.WriteString(l.w, b.String())
+}
+
+func writeJSON(b *strings.Builder, v interface{}) {
+	d, err := json.Marshal(v)
+	if err != nil {
+		d, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(d)
+}
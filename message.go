@@ -6,34 +6,71 @@ import (
 
 // Message is the message structure used for communicating with the config server
 type Message struct {
-	OP      string      `json:"op"`
-	Type    string      `json:"type"`
-	ID      string      `json:"id"`
-	Peers   []string    `json:"peers,omitempty"`
-	Config  interface{} `json:"config,omitempty"`
-	Timeout string      `json:"timeout,omitempty"`
-	Addr    string      `json:"addr,omitempty"`
+	OP        string                 `json:"op"`
+	Type      string                 `json:"type"`
+	ID        string                 `json:"id"`
+	Peers     []string               `json:"peers,omitempty"`
+	States    map[string]string      `json:"states,omitempty"`
+	Config    interface{}            `json:"config,omitempty"`
+	Timeout   string                 `json:"timeout,omitempty"`
+	Heartbeat *Heartbeat             `json:"heartbeat,omitempty"`
+	Version   int64                  `json:"version,omitempty"`
+	Signature string                 `json:"signature,omitempty"`
+	Addr      string                 `json:"addr,omitempty"`
+	Group     string                 `json:"group,omitempty"`
+	Reason    string                 `json:"reason,omitempty"`
+	Drain     string                 `json:"drain,omitempty"`
+	Error     string                 `json:"error,omitempty"`
+	State     string                 `json:"state,omitempty"`
+	Filter    []string               `json:"filter,omitempty"`
+	Stats     map[string]*PeerStats  `json:"stats,omitempty"`
+	Queues    map[string]*QueueStats `json:"queues,omitempty"`
+	Token     string                 `json:"token,omitempty"`
 }
 
 const (
 	// OPGet is the operation for getting the config. Refer to README.md for the protocol
 	OPGet = "get"
 
+	// OPAuth is the operation for presenting a token without any other request
+	OPAuth = "auth"
+
 	// OPConnect is the connect operation
 	OPConnect = "connect"
 
+	// OPDisconnect is the operation for leaving the peer list gracefully
+	OPDisconnect = "disconnect"
+
+	// OPHealth is the operation for updating the health state of a peer
+	OPHealth = "health"
+
+	// OPPeers is the operation for querying the peer list
+	OPPeers = "peers"
+
 	// OPPing is the ping operation
 	OPPing = "ping"
 
 	// OPPong is the ping response
 	OPPong = "pong"
 
+	// OPStats is the admin operation for reading the per peer ping statistics
+	OPStats = "stats"
+
+	// OPQueues is the admin operation for reading the send queue depths
+	OPQueues = "queues"
+
 	// OPPeersChanged is the peers_changed push operation
 	OPPeersChanged = "peers_changed"
 
 	// OPConfigChanged is the config changed push operation
 	OPConfigChanged = "config_changed"
 
+	// OPError is the response to a message that is too large or not a Message
+	OPError = "error"
+
+	// OPClosing is pushed to a connection right before the server closes it
+	OPClosing = "closing"
+
 	TypeRequest  = "request"  // message type request
 	TypeResponse = "response" // message type response
 	TypePush     = "push"     // message type push
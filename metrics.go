@@ -0,0 +1,205 @@
+package cfgsrv
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds in seconds of the latency histograms
+var latencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// metrics are the counters and histograms of a ConfigServer. The gauges are
+// read from the server state when scraped. A nil *metrics records nothing.
+type metrics struct {
+	messages    map[string]int64 // op to messages received
+	messagesMtx sync.Mutex
+
+	evictions      int64 // atomic
+	takeovers      int64 // atomic
+	reloadFailures int64 // atomic
+
+	fanout *histogram // push queued to written to the socket
+	rtt    *histogram // ping to pong
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		messages: make(map[string]int64),
+		fanout:   newHistogram(latencyBuckets),
+		rtt:      newHistogram(latencyBuckets),
+	}
+}
+
+// message counts a message received with op. Unknown ops are counted
+// together so clients cannot grow the label set.
+func (m *metrics) message(op string) {
+	if m == nil {
+		return
+	}
+	if !requestOPs[op] && !responseOPs[op] {
+		op = "unknown"
+	}
+	m.messagesMtx.Lock()
+	m.messages[op]++
+	m.messagesMtx.Unlock()
+}
+
+func (m *metrics) eviction() {
+	if m != nil {
+		atomic.AddInt64(&m.evictions, 1)
+	}
+}
+
+func (m *metrics) takeover() {
+	if m != nil {
+		atomic.AddInt64(&m.takeovers, 1)
+	}
+}
+
+func (m *metrics) reloadFailure() {
+	if m != nil {
+		atomic.AddInt64(&m.reloadFailures, 1)
+	}
+}
+
+func (m *metrics) pushSent(d time.Duration) {
+	if m != nil {
+		m.fanout.observe(d.Seconds())
+	}
+}
+
+func (m *metrics) pingRTT(d time.Duration) {
+	if m != nil {
+		m.rtt.observe(d.Seconds())
+	}
+}
+
+// gauges are the values of a ConfigServer read at scrape time
+type gauges struct {
+	connections   int
+	peers         map[string]map[string]int // group to state to registered peers
+	configVersion int64
+}
+
+// peer counts a registered peer of group in state
+func (g *gauges) peer(group, state string) {
+	if g.peers[group] == nil {
+		g.peers[group] = make(map[string]int)
+	}
+	g.peers[group][state]++
+}
+
+// write writes the metrics in the Prometheus text exposition format
+func (m *metrics) write(w io.Writer, g *gauges) {
+	fmt.Fprintf(w, "# HELP cfgsrv_connections Open websocket connections, gateway requests and watch streams.\n")
+	fmt.Fprintf(w, "# TYPE cfgsrv_connections gauge\n")
+	fmt.Fprintf(w, "cfgsrv_connections %d\n", g.connections)
+
+	groups := make([]string, 0, len(g.peers))
+	for group := range g.peers {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	fmt.Fprintf(w, "# HELP cfgsrv_peers Registered peers by group and health state.\n")
+	fmt.Fprintf(w, "# TYPE cfgsrv_peers gauge\n")
+	for _, group := range groups {
+		for _, state := range sortedKeys(g.peers[group]) {
+			fmt.Fprintf(w, "cfgsrv_peers{group=%q,state=%q} %d\n", group, state, g.peers[group][state])
+		}
+	}
+
+	m.messagesMtx.Lock()
+	messages := make(map[string]int, len(m.messages))
+	for op, n := range m.messages {
+		messages[op] = int(n)
+	}
+	m.messagesMtx.Unlock()
+	fmt.Fprintf(w, "# HELP cfgsrv_messages_total Messages received by op.\n")
+	fmt.Fprintf(w, "# TYPE cfgsrv_messages_total counter\n")
+	for _, op := range sortedKeys(messages) {
+		fmt.Fprintf(w, "cfgsrv_messages_total{op=%q} %d\n", op, messages[op])
+	}
+
+	fmt.Fprintf(w, "# HELP cfgsrv_evictions_total Peers removed by the failure detector.\n")
+	fmt.Fprintf(w, "# TYPE cfgsrv_evictions_total counter\n")
+	fmt.Fprintf(w, "cfgsrv_evictions_total %d\n", atomic.LoadInt64(&m.evictions))
+
+	fmt.Fprintf(w, "# HELP cfgsrv_takeovers_total Registrations taken over by a newer connection.\n")
+	fmt.Fprintf(w, "# TYPE cfgsrv_takeovers_total counter\n")
+	fmt.Fprintf(w, "cfgsrv_takeovers_total %d\n", atomic.LoadInt64(&m.takeovers))
+
+	fmt.Fprintf(w, "# HELP cfgsrv_config_version Version of the config being served.\n")
+	fmt.Fprintf(w, "# TYPE cfgsrv_config_version gauge\n")
+	fmt.Fprintf(w, "cfgsrv_config_version %d\n", g.configVersion)
+
+	fmt.Fprintf(w, "# HELP cfgsrv_config_reload_failures_total Config reloads that failed.\n")
+	fmt.Fprintf(w, "# TYPE cfgsrv_config_reload_failures_total counter\n")
+	fmt.Fprintf(w, "cfgsrv_config_reload_failures_total %d\n", atomic.LoadInt64(&m.reloadFailures))
+
+	m.fanout.write(w, "cfgsrv_push_fanout_seconds", "Time from queuing a push to writing it to the socket.")
+	m.rtt.write(w, "cfgsrv_ping_rtt_seconds", "Round-trip time of the server pings.")
+}
+
+// histogram is a Prometheus histogram with fixed buckets
+type histogram struct {
+	bounds []float64
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+	mtx    sync.Mutex
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	i := sort.SearchFloat64s(h.bounds, v)
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name, help string) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, formatFloat(bound), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
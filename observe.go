@@ -0,0 +1,142 @@
+package cfgsrv
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tonjun/pubsub"
+)
+
+const (
+	// VerifyReject rejects a connect whose addr cannot be dialed
+	VerifyReject = "reject"
+
+	// VerifyFlag registers a peer whose addr cannot be dialed with the
+	// unreachable state
+	VerifyFlag = "flag"
+
+	// DefaultVerifyTimeout is the dial timeout of the addr verification when
+	// Options.VerifyTimeout is not set
+	DefaultVerifyTimeout = 2 * time.Second
+
+	// maxVerifying is the number of addr verifications run at once
+	maxVerifying = 16
+
+	// verifyRate is the number of addr verifications started per second
+	verifyRate = 20
+)
+
+var (
+	// ErrUnreachable is the error of a connect whose addr cannot be dialed
+	// with Options.VerifyAddr set to VerifyReject
+	ErrUnreachable = errors.New("addr unreachable")
+
+	// ErrAddrNotObserved is the error of a connect, with Options.VerifyAddr
+	// set to VerifyReject, whose addr is not on the IP the connection comes
+	// from. Only that IP is ever dialed.
+	ErrAddrNotObserved = errors.New("addr host is not the connection IP")
+)
+
+// observeAddr completes the addr of a connect from the observed remote
+// address of the connection. A wildcard host like ":7070" or "0.0.0.0:7070"
+// gets the remote IP. The port is always the announced one, the source port
+// of the connection is not where the peer listens.
+func observeAddr(addr string, remote net.Addr) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid addr: %q", addr)
+	}
+	if !wildcardHost(host) {
+		return addr, nil
+	}
+	if remote == nil {
+		return "", fmt.Errorf("cannot observe the host of addr: %q", addr)
+	}
+	return normalizeAddr(net.JoinHostPort(hostIP(remote), port))
+}
+
+// observedHost reports whether the host of addr is the IP remote comes from
+func observedHost(addr string, remote net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || remote == nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.Equal(net.ParseIP(hostIP(remote)))
+}
+
+// wildcardHost reports whether host is empty or an unspecified IP
+func wildcardHost(host string) bool {
+	if host == "" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsUnspecified()
+}
+
+// addrVerifier dials the addrs of the connects off the message dispatch, a
+// bounded number at a time and at a bounded rate
+type addrVerifier struct {
+	timeout time.Duration
+	slots   chan struct{}
+	rate    *tokenBucket
+	mtx     sync.Mutex
+}
+
+func newAddrVerifier(timeout time.Duration) *addrVerifier {
+	return &addrVerifier{
+		timeout: timeout,
+		slots:   make(chan struct{}, maxVerifying),
+		rate:    newTokenBucket(verifyRate, verifyRate),
+	}
+}
+
+// start dials addr in the background and calls done with the result. It
+// returns ErrRateLimited without dialing when too many verifications are
+// running or were started in the last second.
+func (v *addrVerifier) start(addr string, done func(err error)) error {
+	v.mtx.Lock()
+	ok := v.rate.take(time.Now())
+	v.mtx.Unlock()
+	if !ok {
+		return ErrRateLimited
+	}
+	select {
+	case v.slots <- struct{}{}:
+	default:
+		return ErrRateLimited
+	}
+	go func() {
+		err := verifyAddr(addr, v.timeout)
+		<-v.slots
+		done(err)
+	}()
+	return nil
+}
+
+// verifyAddr dials addr to check that the other peers can reach it
+func verifyAddr(addr string, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = DefaultVerifyTimeout
+	}
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	return nil
+}
+
+// observedAddr returns the remote address of the client of c, nil if unknown
+func (s *ConfigServer) observedAddr(c pubsub.Conn) net.Addr {
+	if gc, ok := c.(*gatewayConn); ok {
+		return gc.remote
+	}
+	if addr, ok := remoteAddr(c); ok {
+		return addr
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package cfgsrv
+
+import (
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/tonjun/gostore"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("observeAddr", func() {
+
+	remote := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 53211}
+
+	It("should fill in a wildcard host from the remote address", func() {
+		Expect(observeAddr(":7070", remote)).To(Equal("10.1.2.3:7070"))
+		Expect(observeAddr("0.0.0.0:7070", remote)).To(Equal("10.1.2.3:7070"))
+		Expect(observeAddr("[::]:7070", remote)).To(Equal("10.1.2.3:7070"))
+	})
+
+	It("should keep an addr with a host", func() {
+		Expect(observeAddr("192.168.0.100:7070", remote)).To(Equal("192.168.0.100:7070"))
+	})
+
+	It("should refuse an addr without a port", func() {
+		_, err := observeAddr("", remote)
+		Expect(err).NotTo(BeNil())
+		_, err = observeAddr("10.1.2.3", remote)
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("should only match the IP the connection comes from", func() {
+		Expect(observedHost("10.1.2.3:7070", remote)).To(BeTrue())
+		Expect(observedHost("10.1.2.4:7070", remote)).To(BeFalse())
+		Expect(observedHost("example.com:7070", remote)).To(BeFalse())
+		Expect(observedHost("10.1.2.3:7070", nil)).To(BeFalse())
+	})
+
+})
+
+var _ = Describe("addrVerifier", func() {
+
+	It("should limit the verifications started per second", func() {
+		v := newAddrVerifier(100 * time.Millisecond)
+		limited := 0
+		for i := 0; i < 2*verifyRate; i++ {
+			if v.start("127.0.0.1:1", func(error) {}) == ErrRateLimited {
+				limited++
+			}
+		}
+		Expect(limited).To(BeNumerically(">=", verifyRate/2))
+	})
+
+	It("should report the result of the dial", func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+		defer l.Close()
+
+		v := newAddrVerifier(time.Second)
+		done := make(chan error, 2)
+		Expect(v.start(l.Addr().String(), func(err error) { done <- err })).To(Succeed())
+		Expect(<-done).To(BeNil())
+		Expect(v.start(freeAddr(), func(err error) { done <- err })).To(Succeed())
+		Expect(<-done).NotTo(BeNil())
+	})
+
+})
+
+var _ = Describe("Options.VerifyAddr", func() {
+
+	It("should make Start fail with an unknown mode", func() {
+		server := NewConfigServer(&Options{
+			VerifyAddr: "drop",
+			Logger:     NewJSONLogger(ioutil.Discard, LevelError),
+		})
+		Expect(server.Start()).To(MatchError(`unknown verify mode: "drop"`))
+	})
+
+})
+
+var _ = Describe("ConnectHandler addr verification", func() {
+
+	var (
+		store gostore.Store
+		bc    *Broadcaster
+		h     *ConnectHandler
+		c     *testConn
+		opts  *Options
+	)
+
+	connect := func(addr string) *Message {
+		h.ProcessMessage(&Message{
+			OP:   OPConnect,
+			Type: TypeRequest,
+			ID:   "connect",
+			Addr: addr,
+		}, c)
+		var resp *Message
+		Eventually(func() *Message {
+			for _, m := range c.messages() {
+				if m.OP == OPConnect && m.Type == TypeResponse {
+					resp = m
+				}
+			}
+			return resp
+		}).ShouldNot(BeNil())
+		return resp
+	}
+
+	start := func(mode string) {
+		opts.VerifyAddr = mode
+		src := &configSource{}
+		src.set(map[string]interface{}{})
+		h = newConnectHandler(store, src, opts, bc, nil)
+	}
+
+	BeforeEach(func() {
+		store = gostore.NewStore()
+		store.Init()
+		bc, _ = NewBroadcaster(0, "")
+		opts = &Options{
+			Timeout:       3,
+			VerifyTimeout: time.Second,
+			Logger:        NewJSONLogger(ioutil.Discard, LevelError),
+		}
+		c = &testConn{id: 1, remote: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53211}}
+		bc.Add(c)
+	})
+
+	AfterEach(func() {
+		h.Close()
+		bc.Close()
+		store.Close()
+	})
+
+	It("should register a reachable addr", func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+		defer l.Close()
+
+		start(VerifyReject)
+		resp := connect(l.Addr().String())
+		Expect(resp.Error).To(Equal(""))
+		Expect(resp.Peers).To(Equal([]string{l.Addr().String()}))
+	})
+
+	It("should ping the connection that took over a verified addr", func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+		defer l.Close()
+		addr := l.Addr().String()
+
+		// wired like in ConfigServer.Start, the ping loop does not tick
+		// during the test
+		opts.PingInterval = time.Hour
+		start(VerifyReject)
+		ph := newPingHandler(store, opts, bc, nil)
+		defer ph.Close()
+		h.OnPeersDidChange(ph.SetPeers)
+		h.OnPeerRegistered(ph.connected)
+
+		Expect(connect(addr).Error).To(Equal(""))
+
+		// a reconnect takes the addr over once verified
+		old := c
+		c = &testConn{id: 2, remote: old.remote}
+		bc.Add(c)
+		Expect(connect(addr).Error).To(Equal(""))
+		Eventually(old.isClosed).Should(BeTrue())
+
+		pinged := func(tc *testConn) func() bool {
+			return func() bool {
+				for _, m := range tc.messages() {
+					if m.OP == OPPing {
+						return true
+					}
+				}
+				return false
+			}
+		}
+		for i := 0; i < pingSlots; i++ {
+			ph.onTick(time.Now())
+		}
+		Eventually(pinged(c)).Should(BeTrue())
+		Expect(pinged(old)()).To(BeFalse())
+	})
+
+	It("should reject an unreachable addr", func() {
+		start(VerifyReject)
+		resp := connect(freeAddr())
+		Expect(resp.Error).To(Equal(ErrUnreachable.Error()))
+		_, found, _ := store.Get("1")
+		Expect(found).To(BeFalse())
+	})
+
+	It("should flag an unreachable addr", func() {
+		start(VerifyFlag)
+		addr := freeAddr()
+		resp := connect(addr)
+		Expect(resp.Error).To(Equal(""))
+		Expect(resp.States).To(HaveKeyWithValue(addr, StateUnreachable))
+	})
+
+	It("should not dial an addr on another host", func() {
+		start(VerifyReject)
+		resp := connect("192.0.2.1:7070")
+		Expect(resp.Error).To(Equal(ErrAddrNotObserved.Error()))
+	})
+
+	It("should flag an addr on another host without dialing it", func() {
+		start(VerifyFlag)
+		resp := connect("192.0.2.1:7070")
+		Expect(resp.Error).To(Equal(""))
+		Expect(resp.States).To(HaveKeyWithValue("192.0.2.1:7070", StateUnreachable))
+	})
+
+})
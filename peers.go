@@ -0,0 +1,135 @@
+package cfgsrv
+
+import (
+	"fmt"
+
+	"github.com/tonjun/gostore"
+)
+
+const (
+	// StatePassing is the state of a healthy peer. Peers without a state in
+	// peers_changed are passing.
+	StatePassing = "passing"
+
+	// StateWarning is set by a peer that is degraded but still serving
+	StateWarning = "warning"
+
+	// StateCritical is set by a peer that should not receive traffic
+	StateCritical = "critical"
+
+	// StateMaintenance is set by a peer taken out of rotation on purpose
+	StateMaintenance = "maintenance"
+
+	// StateDraining marks a peer that announced its departure with a
+	// disconnect and is about to be removed from the peer list
+	StateDraining = "draining"
+
+	// StateUnreachable marks a peer whose addr could not be dialed on
+	// connect with Options.VerifyAddr set to VerifyFlag
+	StateUnreachable = "unreachable"
+)
+
+// DefaultGroup is the group of the peers that connect without one
+const DefaultGroup = "default"
+
+// validHealthState reports whether state can be set with the health op
+func validHealthState(state string) bool {
+	switch state {
+	case StatePassing, StateWarning, StateCritical, StateMaintenance:
+		return true
+	}
+	return false
+}
+
+// filterPeers returns the peers whose state is one of filter. An empty
+// filter matches every peer.
+func filterPeers(peers []string, states map[string]string, filter []string) []string {
+	if len(filter) == 0 {
+		return peers
+	}
+	res := make([]string, 0)
+	for _, addr := range peers {
+		state, found := states[addr]
+		if !found {
+			state = StatePassing
+		}
+		for _, f := range filter {
+			if f == state {
+				res = append(res, addr)
+				break
+			}
+		}
+	}
+	return res
+}
+
+// filterStates returns the states of the given peers only
+func filterStates(states map[string]string, peers []string) map[string]string {
+	var res map[string]string
+	for _, addr := range peers {
+		if state, found := states[addr]; found {
+			if res == nil {
+				res = make(map[string]string)
+			}
+			res[addr] = state
+		}
+	}
+	return res
+}
+
+// peerStates returns the state of each addr that has one set in the store
+func peerStates(store gostore.Store, addrs []string) map[string]string {
+	var states map[string]string
+	for _, addr := range addrs {
+		item, found, _ := store.Get(fmt.Sprintf("%s-state", addr))
+		if !found {
+			continue
+		}
+		if states == nil {
+			states = make(map[string]string)
+		}
+		states[addr] = item.Value.(string)
+	}
+	return states
+}
+
+// peerAddrs returns the addrs of the peer list
+func peerAddrs(store gostore.Store) []string {
+	items, _, _ := store.ListGet("peers")
+	addrs := make([]string, 0, len(items))
+	for _, item := range items {
+		addrs = append(addrs, item.Value.(string))
+	}
+	return addrs
+}
+
+// peerGroup returns the group addr connected with, DefaultGroup if none
+func peerGroup(store gostore.Store, addr string) string {
+	item, found, _ := store.Get(fmt.Sprintf("%s-group", addr))
+	if !found {
+		return DefaultGroup
+	}
+	return item.Value.(string)
+}
+
+// peerIdentity returns the identity of the connection that registered addr,
+// "" if it had none
+func peerIdentity(store gostore.Store, addr string) string {
+	item, found, _ := store.Get(fmt.Sprintf("%s-identity", addr))
+	if !found {
+		return ""
+	}
+	return item.Value.(string)
+}
+
+// removePeer removes addr from the peer list. The list change is pushed to
+// the remaining peers by the ConnectHandler.
+func removePeer(store gostore.Store, addr string) {
+	store.Del(fmt.Sprintf("%s-state", addr))
+	store.Del(fmt.Sprintf("%s-group", addr))
+	store.ListDel("peers", &gostore.Item{
+		ID:    addr,
+		Key:   "peers",
+		Value: addr,
+	})
+}
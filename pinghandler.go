@@ -2,8 +2,8 @@ package cfgsrv
 
 import (
 	"fmt"
-	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tonjun/gostore"
@@ -11,46 +11,228 @@ import (
 )
 
 // PingHandler is a config server handler that handles pong operation from client
-// by periodically sending ping to all the connected clients and handling the response
+// by periodically sending ping to all the connected clients and handling the response.
+//
+// The peers are spread over pingSlots buckets and every tick pings a single
+// bucket with one serialized message. Liveness is kept in memory by the
+// FailureDetector and checked when the deadline of a peer comes up on a
+// timer wheel, so a pong costs no store write.
 type PingHandler struct {
 	store    gostore.Store
 	opts     *Options
+	hb       heartbeat
+	fd       FailureDetector
+	bc       *Broadcaster
+	mt       *metrics
+	log      Logger
 	done     chan bool
+	lastTick int64 // atomic, unix nanoseconds of the last ping loop tick
 	reqID    int64
 	reqIDMtx sync.Mutex
+
+	peers     map[string]*trackedPeer // addr to tracked peer
+	buckets   []map[string]*trackedPeer
+	bucket    int // bucket pinged on the next tick
+	deadlines *timerWheel
+	peersMtx  sync.Mutex
+
+	sent     map[string]time.Time // ping ID to send time
+	stats    map[string]*rttStats // addr to round-trip times
+	statsMtx sync.Mutex
+
+	onStateChange    func()
+	onStateChangeMtx sync.Mutex
+
+	standalone bool // tracks the peers from their connects, see NewPingHandler
+}
+
+// trackedPeer is a registered peer as seen by the PingHandler
+type trackedPeer struct {
+	conn   pubsub.Conn
+	bucket int
 }
 
-// NewPingHandler creates a new instance of PingHandler
+// NewPingHandler creates a PingHandler for a server built on the handlers
+// rather than a ConfigServer. It starts tracking a peer when the connect
+// that registered it goes through, so it must come after the ConnectHandler.
+// Its messages are sent from the handler, without send queues.
 func NewPingHandler(store gostore.Store, opts *Options) Handler {
+	h := newPingHandler(store, opts, newDirectBroadcaster(), nil)
+	h.standalone = true
+	return h
+}
+
+// newPingHandler creates a new instance of PingHandler
+func newPingHandler(store gostore.Store, opts *Options, bc *Broadcaster, mt *metrics) *PingHandler {
 	h := &PingHandler{
-		store: store,
-		opts:  opts,
-		done:  make(chan bool),
+		store:   store,
+		opts:    opts,
+		hb:      newHeartbeat(opts),
+		fd:      opts.FailureDetector,
+		bc:      bc,
+		mt:      mt,
+		log:     loggerOf(opts),
+		done:    make(chan bool),
+		peers:   make(map[string]*trackedPeer),
+		buckets: make([]map[string]*trackedPeer, pingSlots),
+		sent:    make(map[string]time.Time),
+		stats:   make(map[string]*rttStats),
 	}
-	log.Printf("NewPingHandler timeout: %d", opts.Timeout)
+	if h.fd == nil {
+		h.fd = newTTLDetector(h.hb.timeout())
+	}
+	for i := range h.buckets {
+		h.buckets[i] = make(map[string]*trackedPeer)
+	}
+	now := time.Now()
+	h.deadlines = newTimerWheel(h.hb.slot(), h.hb.timeout()+h.hb.interval, now)
+	h.lastTick = now.UnixNano()
+	h.log.Debug("ping handler", Fields{"timeout": h.hb.timeout()})
 	go h.pingLoop()
-	store.OnItemDidExpire(h.onItemDidExpire)
 	return h
 }
 
 // ProcessMessage is the implementation of the Handler interface
 func (h *PingHandler) ProcessMessage(m *Message, c pubsub.Conn) {
 
-	if m.OP != OPPong { // handle only pong operations
+	switch {
+	case m.OP == OPConnect && h.standalone:
+		h.connected(m.Addr, c)
+
+	case m.OP == OPStats:
+		h.sendStats(m, c)
+
+	case m.OP == OPPong:
+		h.alive(c, m.ID)
+
+	case m.OP == OPPing && m.Type == TypeRequest:
+		// client initiated heartbeat
+		resp := &Message{
+			OP:   OPPong,
+			Type: TypeResponse,
+			ID:   m.ID,
+		}
+		h.bc.Send(c, resp)
+		h.alive(c, "")
+	}
+}
+
+// connected starts tracking addr on c with a fresh heartbeat history once
+// the ConnectHandler registered it, see ConnectHandler.OnPeerRegistered. A
+// peer already tracked is pinged on c from now on.
+func (h *PingHandler) connected(addr string, c pubsub.Conn) {
+	item, found, _ := h.store.Get(fmt.Sprintf("%d", c.ID()))
+	if !found || item.Value.(string) != addr {
 		return
 	}
 
-	// get addr given connection ID and update the mem store
+	h.fd.Forget(addr)
+	h.fd.Heartbeat(addr, time.Now())
+
+	h.peersMtx.Lock()
+	defer h.peersMtx.Unlock()
+	if p, found := h.peers[addr]; found {
+		p.conn = c
+		return
+	}
+	h.track(addr, c)
+}
+
+// alive records a sign of life from the peer of c. pingID is the ID of the
+// server ping being answered, if any.
+func (h *PingHandler) alive(c pubsub.Conn, pingID string) {
+
+	// get addr given connection ID
 	item, found, _ := h.store.Get(fmt.Sprintf("%d", c.ID()))
-	if found {
-		addr := item.Value.(string)
-		log.Printf("updating ping for addr: %s", addr)
-		h.store.Put(&gostore.Item{
-			ID:    fmt.Sprintf("%s-ping", addr),
-			Key:   fmt.Sprintf("%s-ping", addr),
-			Value: addr,
-		}, time.Duration(h.opts.Timeout)*time.Second)
+	if !found {
+		return
+	}
+	addr := item.Value.(string)
+
+	h.peersMtx.Lock()
+	_, tracked := h.peers[addr]
+	h.peersMtx.Unlock()
+	if !tracked {
+		return
+	}
+	h.recordPong(addr, pingID)
+	h.fd.Heartbeat(addr, time.Now())
+}
+
+// SetPeers syncs the tracked peers with the peer list
+func (h *PingHandler) SetPeers(addrs []string) {
+	listed := make(map[string]bool)
+
+	h.peersMtx.Lock()
+	defer h.peersMtx.Unlock()
+
+	for _, addr := range addrs {
+		listed[addr] = true
+		if _, found := h.peers[addr]; found {
+			continue
+		}
+		item, found, _ := h.store.Get(addr)
+		if !found {
+			continue
+		}
+		h.fd.Heartbeat(addr, time.Now())
+		h.track(addr, item.Value.(pubsub.Conn))
+	}
+	for addr := range h.peers {
+		if !listed[addr] {
+			h.untrack(addr)
+		}
+	}
+}
+
+// track adds addr to the least loaded ping bucket and schedules its first
+// liveness check. Must be called with peersMtx held.
+func (h *PingHandler) track(addr string, c pubsub.Conn) {
+	b := 0
+	for i := range h.buckets {
+		if len(h.buckets[i]) < len(h.buckets[b]) {
+			b = i
+		}
+	}
+	p := &trackedPeer{
+		conn:   c,
+		bucket: b,
+	}
+	h.peers[addr] = p
+	h.buckets[b][addr] = p
+	h.deadlines.schedule(addr, h.nextCheck(addr, time.Now()))
+}
+
+// untrack stops pinging and checking addr. Must be called with peersMtx held.
+func (h *PingHandler) untrack(addr string) {
+	p, found := h.peers[addr]
+	if !found {
+		return
+	}
+	delete(h.peers, addr)
+	delete(h.buckets[p.bucket], addr)
+	h.deadlines.remove(addr)
+	h.fd.Forget(addr)
+
+	h.statsMtx.Lock()
+	delete(h.stats, addr)
+	h.statsMtx.Unlock()
+}
+
+// nextCheck returns when the liveness of addr should be checked again
+func (h *PingHandler) nextCheck(addr string, now time.Time) time.Time {
+	if d, ok := h.fd.(interface{ Deadline(string) time.Time }); ok {
+		return d.Deadline(addr)
 	}
+	return now.Add(h.hb.interval)
+}
+
+// OnPeerStateDidChange sets the callback called when the failure detector
+// marks a peer as suspect or alive again
+func (h *PingHandler) OnPeerStateDidChange(f func()) {
+	h.onStateChangeMtx.Lock()
+	defer h.onStateChangeMtx.Unlock()
+	h.onStateChange = f
 }
 
 // Close closes the PingHandler
@@ -59,49 +241,159 @@ func (h *PingHandler) Close() {
 }
 
 func (h *PingHandler) pingLoop() {
-	defer log.Printf("pingLoop done")
+	defer h.log.Debug("ping loop done", nil)
 
-	p := (h.opts.Timeout * 1000) * 5 / 10
-	log.Printf("pingLoop every: %d ms", p)
-
-	//p = 1000
+	h.log.Debug("ping loop", Fields{"interval": h.hb.interval, "jitter": h.hb.jitter})
 
 	for {
 		select {
 		case <-h.done:
 			return
 
-		case <-time.After(time.Duration(p) * time.Millisecond):
-			items, found, _ := h.store.ListGet("peers")
-			if found {
-				m := &Message{
-					OP:   OPPing,
-					Type: TypeRequest,
-					ID:   h.genReqID(),
-				}
-				for _, item := range items {
-					addr := item.Value.(string)
-					item, found, _ := h.store.Get(addr)
-					if found {
-						conn := item.Value.(pubsub.Conn)
-						conn.Send(m.ToBytes())
-					}
-				}
+		case <-time.After(h.hb.tick()):
+			now := time.Now()
+			h.onTick(now)
+			atomic.StoreInt64(&h.lastTick, now.UnixNano())
+		}
+	}
+}
+
+// stalled returns how long the ping loop has not ticked, if that is longer
+// than a whole ping interval
+func (h *PingHandler) stalled(now time.Time) (time.Duration, bool) {
+	d := now.Sub(time.Unix(0, atomic.LoadInt64(&h.lastTick)))
+	return d, d > h.hb.interval+h.hb.jitter
+}
+
+// onTick pings the peers of the next bucket and checks the peers whose
+// deadline is up
+func (h *PingHandler) onTick(now time.Time) {
+	h.peersMtx.Lock()
+	conns := make([]pubsub.Conn, 0, len(h.buckets[h.bucket]))
+	for _, p := range h.buckets[h.bucket] {
+		conns = append(conns, p.conn)
+	}
+	h.bucket = (h.bucket + 1) % len(h.buckets)
+	due := h.deadlines.advance(now)
+	h.peersMtx.Unlock()
+
+	if len(conns) > 0 {
+		m := &Message{
+			OP:   OPPing,
+			Type: TypeRequest,
+			ID:   h.genReqID(),
+		}
+		h.recordPing(m.ID, now)
+		h.bc.Broadcast(conns, m)
+	}
+
+	if len(due) > 0 {
+		h.checkPeers(due, now)
+	}
+}
+
+// checkPeers asks the failure detector about the given peers. Dead peers
+// are removed and suspect peers are listed with the suspect state.
+func (h *PingHandler) checkPeers(addrs []string, now time.Time) {
+	changed := false
+	for _, addr := range addrs {
+		liveness := h.fd.Check(addr, now)
+		if liveness == Dead {
+			h.log.Info("peer dead", Fields{"addr": addr})
+			h.mt.eviction()
+			h.peersMtx.Lock()
+			h.untrack(addr)
+			h.peersMtx.Unlock()
+			removePeer(h.store, addr)
+			continue
+		}
+
+		key := fmt.Sprintf("%s-state", addr)
+		state, found, _ := h.store.Get(key)
+		switch liveness {
+		case Suspect:
+			// health states set by the peer itself take precedence
+			if !found {
+				h.log.Info("peer suspect", Fields{"addr": addr})
+				h.store.Put(&gostore.Item{
+					ID:    key,
+					Key:   key,
+					Value: StateSuspect,
+				}, 0)
+				changed = true
 			}
 
+		case Alive:
+			if found && state.Value.(string) == StateSuspect {
+				h.store.Del(key)
+				changed = true
+			}
+		}
+
+		h.peersMtx.Lock()
+		if _, found := h.peers[addr]; found {
+			h.deadlines.schedule(addr, h.nextCheck(addr, now))
 		}
+		h.peersMtx.Unlock()
+	}
+
+	h.onStateChangeMtx.Lock()
+	f := h.onStateChange
+	h.onStateChangeMtx.Unlock()
+	if changed && f != nil {
+		f()
 	}
 }
 
-func (h *PingHandler) onItemDidExpire(item *gostore.Item) {
-	addr := item.Value.(string)
-	log.Printf("connection: \"%s\" expired key: \"%s\"", addr, item.Key)
+// recordPing remembers when ping id was sent, and forgets the pings that
+// can no longer be answered
+func (h *PingHandler) recordPing(id string, now time.Time) {
+	h.statsMtx.Lock()
+	defer h.statsMtx.Unlock()
+
+	for pid, t := range h.sent {
+		if now.Sub(t) > h.hb.timeout() {
+			delete(h.sent, pid)
+		}
+	}
+	h.sent[id] = now
+}
+
+// recordPong records the round-trip time of the pong to ping id from addr.
+// An empty id only updates the last seen time.
+func (h *PingHandler) recordPong(addr, id string) {
+	h.statsMtx.Lock()
+	defer h.statsMtx.Unlock()
 
-	h.store.ListDel("peers", &gostore.Item{
-		ID:    addr,
-		Key:   "peers",
-		Value: addr,
-	})
+	now := time.Now()
+	s, found := h.stats[addr]
+	if !found {
+		s = newRTTStats()
+		h.stats[addr] = s
+	}
+	s.seen(now)
+	if id == "" {
+		return
+	}
+	if t, found := h.sent[id]; found {
+		s.record(now.Sub(t))
+		h.mt.pingRTT(now.Sub(t))
+	}
+}
+
+func (h *PingHandler) sendStats(m *Message, c pubsub.Conn) {
+	resp := &Message{
+		OP:    OPStats,
+		Type:  TypeResponse,
+		ID:    m.ID,
+		Stats: make(map[string]*PeerStats),
+	}
+	h.statsMtx.Lock()
+	for addr, s := range h.stats {
+		resp.Stats[addr] = s.snapshot()
+	}
+	h.statsMtx.Unlock()
+	h.bc.Send(c, resp)
 }
 
 func (h *PingHandler) genReqID() string {
@@ -0,0 +1,145 @@
+package cfgsrv
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/tonjun/gostore"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("heartbeat", func() {
+
+	It("should not ping faster than minPingInterval", func() {
+		hb := newHeartbeat(&Options{})
+		Expect(hb.interval).To(Equal(minPingInterval))
+		Expect(hb.slot()).To(Equal(minPingInterval / pingSlots))
+		Expect(hb.timeout()).To(Equal(2 * minPingInterval))
+	})
+
+})
+
+var _ = Describe("PingHandler", func() {
+
+	var (
+		store gostore.Store
+		bc    *Broadcaster
+		h     *PingHandler
+		conns map[string]*testConn
+	)
+
+	// register puts the n peers from 10.0.0.<first> in the store
+	register := func(first, n int) []string {
+		addrs := make([]string, 0, n)
+		for i := first; i < first+n; i++ {
+			addr := fmt.Sprintf("10.0.0.%d:7070", i)
+			c := &testConn{id: int64(i)}
+			bc.Add(c)
+			store.Put(&gostore.Item{ID: addr, Key: addr, Value: c}, 0)
+			conns[addr] = c
+			addrs = append(addrs, addr)
+		}
+		return addrs
+	}
+
+	bucketSizes := func() []int {
+		h.peersMtx.Lock()
+		defer h.peersMtx.Unlock()
+		sizes := make([]int, 0, len(h.buckets))
+		for _, b := range h.buckets {
+			sizes = append(sizes, len(b))
+		}
+		return sizes
+	}
+
+	pinged := func(c *testConn) bool {
+		for _, m := range c.messages() {
+			if m.OP == OPPing {
+				return true
+			}
+		}
+		return false
+	}
+
+	BeforeEach(func() {
+		store = gostore.NewStore()
+		store.Init()
+		bc, _ = NewBroadcaster(0, "")
+		conns = make(map[string]*testConn)
+
+		// the ping loop does not tick during a test, onTick is called
+		// directly
+		h = newPingHandler(store, &Options{
+			PingInterval: time.Hour,
+			Logger:       NewJSONLogger(ioutil.Discard, LevelError),
+		}, bc, nil)
+	})
+
+	AfterEach(func() {
+		h.Close()
+		bc.Close()
+		store.Close()
+	})
+
+	It("should spread the peers evenly over the buckets", func() {
+		h.SetPeers(register(1, 25))
+		for _, n := range bucketSizes() {
+			Expect(n).To(BeNumerically(">=", 2))
+			Expect(n).To(BeNumerically("<=", 3))
+		}
+	})
+
+	It("should fill the least loaded bucket first", func() {
+		addrs := register(1, pingSlots)
+		h.SetPeers(addrs)
+		Expect(bucketSizes()).To(ConsistOf(1, 1, 1, 1, 1, 1, 1, 1, 1, 1))
+
+		// the peer leaving bucket 3 is replaced there
+		h.peersMtx.Lock()
+		b := h.peers[addrs[3]].bucket
+		h.peersMtx.Unlock()
+		addrs = append(addrs[:3], addrs[4:]...)
+		h.SetPeers(addrs)
+		h.SetPeers(append(addrs, register(100, 1)...))
+
+		h.peersMtx.Lock()
+		defer h.peersMtx.Unlock()
+		Expect(h.peers["10.0.0.100:7070"].bucket).To(Equal(b))
+	})
+
+	It("should ping one bucket per tick", func() {
+		h.SetPeers(register(1, 2*pingSlots))
+		now := time.Now()
+		for tick := 0; tick < pingSlots; tick++ {
+			h.peersMtx.Lock()
+			next := make([]*testConn, 0)
+			for addr := range h.buckets[h.bucket] {
+				next = append(next, conns[addr])
+			}
+			h.peersMtx.Unlock()
+
+			h.onTick(now)
+			for _, c := range next {
+				Eventually(func() bool { return pinged(c) }).Should(BeTrue())
+			}
+		}
+		for _, c := range conns {
+			Expect(c.messages()).To(HaveLen(1))
+		}
+	})
+
+	It("should evict a peer whose deadline a late tick passed", func() {
+		addrs := register(1, 1)
+		h.SetPeers(addrs)
+
+		// a single tick long after the eviction timeout
+		h.onTick(time.Now().Add(3 * time.Hour))
+		h.peersMtx.Lock()
+		defer h.peersMtx.Unlock()
+		Expect(h.peers).To(BeEmpty())
+	})
+
+})
@@ -0,0 +1,86 @@
+package cfgsrv
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Reload", func() {
+
+	var (
+		dir    string
+		config string
+		addr   string
+		server *ConfigServer
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "cfgsrv-reload")
+		Expect(err).To(BeNil())
+		config = writeTemp(dir, "config.json", `{"feature1":{"enable":false}}`)
+		server, addr = startServer(dir, &Options{ConfigFile: config})
+	})
+
+	AfterEach(func() {
+		server.Stop()
+		os.RemoveAll(dir)
+	})
+
+	It("should push the new version to the registered peers", func() {
+		peer := dialWS(addr)
+		defer peer.Close()
+		sendWS(peer, &Message{OP: OPConnect, Type: TypeRequest, ID: "c1", Addr: "127.0.0.1:7171"})
+		Expect(readOP(peer, OPConnect).Error).To(Equal(""))
+
+		// not registered, gets no push
+		other := dialWS(addr)
+		defer other.Close()
+		sendWS(other, &Message{OP: OPGet, Type: TypeRequest, ID: "g1"})
+		readOP(other, OPGet)
+
+		version := server.src.current()
+		writeTemp(dir, "config.json", `{"feature1":{"enable":true}}`)
+		Expect(server.Reload()).To(Succeed())
+		Expect(server.src.current()).To(BeNumerically(">", version))
+
+		m := readOP(peer, OPConfigChanged)
+		Expect(m.Type).To(Equal(TypePush))
+		Expect(m.ID).To(Equal(fmt.Sprintf("config-%d", server.src.current())))
+		Expect(m.Config).To(Equal(map[string]interface{}{
+			"feature1": map[string]interface{}{"enable": true},
+		}))
+
+		sendWS(other, &Message{OP: OPGet, Type: TypeRequest, ID: "g2"})
+		m = readOP(other, OPGet)
+		Expect(m.ID).To(Equal("g2"))
+		Expect(m.Config).To(Equal(map[string]interface{}{
+			"feature1": map[string]interface{}{"enable": true},
+		}))
+	})
+
+	It("should keep the current version when the new config does not load", func() {
+		conn := dialWS(addr)
+		defer conn.Close()
+
+		version := server.src.current()
+		writeTemp(dir, "config.json", `{"feature1":`)
+		Expect(server.Reload()).NotTo(Succeed())
+		Expect(os.Remove(filepath.Join(dir, "config.json"))).To(Succeed())
+		Expect(server.Reload()).NotTo(Succeed())
+
+		Expect(server.src.current()).To(Equal(version))
+		Expect(server.metrics.reloadFailures).To(Equal(int64(2)))
+
+		sendWS(conn, &Message{OP: OPGet, Type: TypeRequest, ID: "g1"})
+		Expect(readOP(conn, OPGet).Config).To(Equal(map[string]interface{}{
+			"feature1": map[string]interface{}{"enable": false},
+		}))
+	})
+
+})
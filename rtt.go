@@ -0,0 +1,100 @@
+package cfgsrv
+
+import (
+	"sort"
+	"time"
+)
+
+// rttWindow is the number of round-trip samples kept per peer
+const rttWindow = 128
+
+// PeerStats is the liveness and round-trip time summary of a peer as
+// returned by the stats op
+type PeerStats struct {
+	Last     string `json:"last"`
+	Avg      string `json:"avg"`
+	P50      string `json:"p50"`
+	P90      string `json:"p90"`
+	P99      string `json:"p99"`
+	Pongs    int64  `json:"pongs"`
+	LastSeen string `json:"last_seen"`
+}
+
+// rttStats keeps the recent round-trip times of a single peer
+type rttStats struct {
+	samples  []time.Duration
+	next     int
+	pongs    int64
+	lastSeen time.Time
+}
+
+func newRTTStats() *rttStats {
+	return &rttStats{
+		samples: make([]time.Duration, 0, rttWindow),
+	}
+}
+
+// seen records that the peer was heard from at t
+func (s *rttStats) seen(t time.Time) {
+	s.lastSeen = t
+}
+
+// record adds a round-trip sample
+func (s *rttStats) record(rtt time.Duration) {
+	s.pongs++
+	if len(s.samples) < rttWindow {
+		s.samples = append(s.samples, rtt)
+		s.next = len(s.samples) % rttWindow
+		return
+	}
+	s.samples[s.next] = rtt
+	s.next = (s.next + 1) % rttWindow
+}
+
+// last returns the most recent sample
+func (s *rttStats) last() time.Duration {
+	if len(s.samples) == 0 {
+		return 0
+	}
+	return s.samples[(s.next+len(s.samples)-1)%len(s.samples)]
+}
+
+// snapshot summarizes the samples
+func (s *rttStats) snapshot() *PeerStats {
+	ps := &PeerStats{
+		Last:  s.last().String(),
+		Pongs: s.pongs,
+	}
+	if !s.lastSeen.IsZero() {
+		ps.LastSeen = s.lastSeen.UTC().Format(time.RFC3339Nano)
+	}
+
+	sorted := make([]time.Duration, len(s.samples))
+	copy(sorted, s.samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var sum time.Duration
+	for _, d := range sorted {
+		sum += d
+	}
+	if len(sorted) > 0 {
+		sum /= time.Duration(len(sorted))
+	}
+	ps.Avg = sum.String()
+	ps.P50 = percentile(sorted, 50).String()
+	ps.P90 = percentile(sorted, 90).String()
+	ps.P99 = percentile(sorted, 99).String()
+	return ps
+}
+
+// percentile returns the nearest-rank percentile p of sorted samples
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (len(sorted)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
@@ -0,0 +1,110 @@
+package cfgsrv
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Secret is a config value resolved from a $secret reference. It formats as
+// [redacted] so it never shows up in logs, and marshals to its value for the
+// identities allowed to read secrets.
+type Secret string
+
+// String implements fmt.Stringer
+func (s Secret) String() string {
+	return "[redacted]"
+}
+
+// GoString implements fmt.GoStringer
+func (s Secret) GoString() string {
+	return "[redacted]"
+}
+
+// MarshalJSON implements json.Marshaler
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(string(s))
+}
+
+// resolveSecrets replaces the {"$secret": "file:/path"} and
+// {"$secret": "env:NAME"} references in v with the Secret they point to
+func resolveSecrets(v interface{}) (interface{}, error) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if ref, ok := secretRef(t); ok {
+			return resolveSecret(ref)
+		}
+		for k, sub := range t {
+			r, err := resolveSecrets(sub)
+			if err != nil {
+				return nil, err
+			}
+			t[k] = r
+		}
+	case []interface{}:
+		for i, sub := range t {
+			r, err := resolveSecrets(sub)
+			if err != nil {
+				return nil, err
+			}
+			t[i] = r
+		}
+	}
+	return v, nil
+}
+
+// secretRef returns the reference of a {"$secret": ref} object
+func secretRef(m map[string]interface{}) (string, bool) {
+	if len(m) != 1 {
+		return "", false
+	}
+	ref, ok := m["$secret"].(string)
+	return ref, ok
+}
+
+func resolveSecret(ref string) (Secret, error) {
+	switch {
+	case strings.HasPrefix(ref, "file:"):
+		d, err := ioutil.ReadFile(strings.TrimPrefix(ref, "file:"))
+		if err != nil {
+			return "", fmt.Errorf("secret %s: %s", ref, err.Error())
+		}
+		return Secret(strings.TrimRight(string(d), "\r\n")), nil
+
+	case strings.HasPrefix(ref, "env:"):
+		v, found := os.LookupEnv(strings.TrimPrefix(ref, "env:"))
+		if !found {
+			return "", fmt.Errorf("secret %s: not set", ref)
+		}
+		return Secret(v), nil
+	}
+	return "", fmt.Errorf("secret %s: unknown source", ref)
+}
+
+// withoutSecrets returns a copy of v without the Secret values. Secrets in
+// objects are left out and secrets in arrays become null.
+func withoutSecrets(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(t))
+		for k, sub := range t {
+			if _, ok := sub.(Secret); ok {
+				continue
+			}
+			res[k] = withoutSecrets(sub)
+		}
+		return res
+	case []interface{}:
+		res := make([]interface{}, len(t))
+		for i, sub := range t {
+			if _, ok := sub.(Secret); ok {
+				continue
+			}
+			res[i] = withoutSecrets(sub)
+		}
+		return res
+	}
+	return v
+}
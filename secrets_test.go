@@ -0,0 +1,119 @@
+package cfgsrv
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("secrets", func() {
+
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "cfgsrv-secrets")
+		Expect(err).To(BeNil())
+		os.Setenv("CFGSRV_TEST_SECRET", "env-secret")
+	})
+
+	AfterEach(func() {
+		os.Unsetenv("CFGSRV_TEST_SECRET")
+		os.RemoveAll(dir)
+	})
+
+	It("should resolve the file and env references anywhere in the config", func() {
+		file := writeTemp(dir, "pass", "file-secret\n")
+		config, err := loadConfigFile(writeTemp(dir, "config.json", `{
+			"db": {"user": "app", "pass": {"$secret": "file:`+file+`"}},
+			"tokens": ["public", {"$secret": "env:CFGSRV_TEST_SECRET"}]
+		}`), nil)
+		Expect(err).To(BeNil())
+		Expect(config["db"].(map[string]interface{})["pass"]).To(Equal(Secret("file-secret")))
+		Expect(config["tokens"].([]interface{})[1]).To(Equal(Secret("env-secret")))
+	})
+
+	It("should refuse a $secret reference as the config root", func() {
+		_, err := loadConfigFile(writeTemp(dir, "config.json", `{"$secret": "env:CFGSRV_TEST_SECRET"}`), nil)
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("should fail on a missing or unknown secret source", func() {
+		for _, ref := range []string{"env:CFGSRV_TEST_MISSING", "file:" + dir + "/missing", "vault:db"} {
+			_, err := loadConfigFile(writeTemp(dir, "config.json", `{"pass": {"$secret": "`+ref+`"}}`), nil)
+			Expect(err).NotTo(BeNil())
+		}
+	})
+
+	It("should not show up in logs", func() {
+		s := Secret("hunter2")
+		Expect(fmt.Sprintf("%v %s %#v", s, s, s)).NotTo(ContainSubstring("hunter2"))
+		Expect(fmt.Sprintf("%v", map[string]interface{}{"pass": s})).NotTo(ContainSubstring("hunter2"))
+
+		b, err := json.Marshal(map[string]interface{}{"pass": s})
+		Expect(err).To(BeNil())
+		Expect(string(b)).To(Equal(`{"pass":"hunter2"}`))
+	})
+
+	Describe("release per identity", func() {
+
+		config := func() map[string]interface{} {
+			return map[string]interface{}{
+				"db":     map[string]interface{}{"user": "app", "pass": Secret("hunter2")},
+				"tokens": []interface{}{"public", Secret("t0ken")},
+			}
+		}
+		redacted := map[string]interface{}{
+			"db":     map[string]interface{}{"user": "app"},
+			"tokens": []interface{}{"public", nil},
+		}
+
+		It("should release secrets to authenticated identities only without an ACL", func() {
+			var acl *ACL
+			Expect(acl.Redact("", config())).To(Equal(redacted))
+			Expect(acl.Redact("service-a", config())).To(Equal(config()))
+		})
+
+		It("should release secrets to the ACL rules that allow them", func() {
+			acl := &ACL{
+				Identities: map[string]*ACLRule{
+					"service-a": {Paths: []string{"*"}, Secrets: true},
+					"service-b": {Paths: []string{"*"}},
+				},
+				Default: &ACLRule{Paths: []string{"db"}, Secrets: true},
+			}
+			Expect(acl.Redact("service-a", config())).To(Equal(config()))
+			Expect(acl.Redact("service-b", config())).To(Equal(redacted))
+			Expect(acl.Redact("", config())).To(Equal(map[string]interface{}{
+				"db": map[string]interface{}{"user": "app", "pass": Secret("hunter2")},
+			}))
+		})
+
+		It("should serve the config of a connection as its identity may read it", func() {
+			src := &configSource{
+				acl: &ACL{
+					Identities: map[string]*ACLRule{"service-a": {Paths: []string{"*"}, Secrets: true}},
+					Default:    &ACLRule{Paths: []string{"*"}},
+				},
+			}
+			src.set(config())
+
+			m := &Message{}
+			src.fill(m, "service-a")
+			b, _ := json.Marshal(m.Config)
+			Expect(string(b)).To(ContainSubstring("hunter2"))
+
+			m = &Message{}
+			src.fill(m, "")
+			b, _ = json.Marshal(m.Config)
+			Expect(string(b)).NotTo(ContainSubstring("hunter2"))
+			Expect(string(b)).NotTo(ContainSubstring("t0ken"))
+		})
+
+	})
+
+})
@@ -0,0 +1,64 @@
+package cfgsrv
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// ErrBadSignature is returned by VerifyConfig for a missing or invalid
+// config signature
+var ErrBadSignature = errors.New("bad config signature")
+
+// LoadSigningKey reads the ed25519 key that signs the config, either a PEM
+// encoded PKCS #8 private key or a base64 encoded 32 byte seed
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(d); block != nil {
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		edKey, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s is not an ed25519 key", path)
+		}
+		return edKey, nil
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(d)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s is not a PEM or base64 ed25519 key", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// signedPayload is what is signed for a config version: the canonical JSON
+// {"version":<version>,"config":<config>}. config is the compact JSON of
+// the config exactly as sent.
+func signedPayload(version int64, config []byte) []byte {
+	return []byte(fmt.Sprintf(`{"version":%d,"config":%s}`, version, config))
+}
+
+// SignConfig returns the base64 signature of a config version
+func SignConfig(key ed25519.PrivateKey, version int64, config []byte) string {
+	sig := ed25519.Sign(key, signedPayload(version, config))
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+// VerifyConfig checks the signature of a config version against a pinned
+// public key
+func VerifyConfig(key ed25519.PublicKey, version int64, config []byte, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || !ed25519.Verify(key, signedPayload(version, config), sig) {
+		return ErrBadSignature
+	}
+	return nil
+}
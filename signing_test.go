@@ -0,0 +1,153 @@
+package cfgsrv
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("config signing", func() {
+
+	var (
+		dir  string
+		pub  ed25519.PublicKey
+		priv ed25519.PrivateKey
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "cfgsrv-signing")
+		Expect(err).To(BeNil())
+		pub, priv, err = ed25519.GenerateKey(rand.Reader)
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should load a PEM or base64 seed key", func() {
+		der, err := x509.MarshalPKCS8PrivateKey(priv)
+		Expect(err).To(BeNil())
+		key, err := LoadSigningKey(writeTemp(dir, "key.pem", string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))))
+		Expect(err).To(BeNil())
+		Expect(key).To(Equal(priv))
+
+		key, err = LoadSigningKey(writeTemp(dir, "key.b64", base64.StdEncoding.EncodeToString(priv.Seed())+"\n"))
+		Expect(err).To(BeNil())
+		Expect(key).To(Equal(priv))
+
+		_, err = LoadSigningKey(writeTemp(dir, "key.bad", "not a key"))
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("should verify what it signs", func() {
+		config := []byte(`{"feature1":{"enable":true}}`)
+		sig := SignConfig(priv, 3, config)
+		Expect(VerifyConfig(pub, 3, config, sig)).To(Succeed())
+	})
+
+	It("should reject a tampered config, version or signature", func() {
+		config := []byte(`{"feature1":{"enable":true}}`)
+		sig := SignConfig(priv, 3, config)
+
+		Expect(VerifyConfig(pub, 3, []byte(`{"feature1":{"enable":false}}`), sig)).To(Equal(ErrBadSignature))
+		Expect(VerifyConfig(pub, 4, config, sig)).To(Equal(ErrBadSignature))
+		Expect(VerifyConfig(pub, 3, config, "")).To(Equal(ErrBadSignature))
+		Expect(VerifyConfig(pub, 3, config, "!!!")).To(Equal(ErrBadSignature))
+
+		raw, _ := base64.StdEncoding.DecodeString(sig)
+		raw[0] ^= 1
+		Expect(VerifyConfig(pub, 3, config, base64.StdEncoding.EncodeToString(raw))).To(Equal(ErrBadSignature))
+
+		other, _, _ := ed25519.GenerateKey(rand.Reader)
+		Expect(VerifyConfig(other, 3, config, sig)).To(Equal(ErrBadSignature))
+	})
+
+	Describe("Client", func() {
+
+		var (
+			addr   string
+			server *ConfigServer
+		)
+
+		BeforeEach(func() {
+			key := writeTemp(dir, "key.b64", base64.StdEncoding.EncodeToString(priv.Seed()))
+			server, addr = startServer(dir, &Options{SigningKeyFile: key})
+		})
+
+		AfterEach(func() {
+			server.Stop()
+		})
+
+		It("should accept the signed config and its newer versions", func() {
+			cli := NewClientWithOptions(addr, &ClientOptions{PublicKey: pub})
+			Eventually(func() error {
+				_, err := cli.GetConfig()
+				return err
+			}).Should(BeNil())
+
+			// the same version again is fine
+			config, err := cli.GetConfig()
+			Expect(err).To(BeNil())
+			Expect(config).To(Equal(`{"feature1":{"enable":true}}`))
+
+			writeTemp(dir, "config.json", `{"feature1":{"enable":false}}`)
+			Expect(server.Reload()).To(Succeed())
+			config, err = cli.GetConfig()
+			Expect(err).To(BeNil())
+			Expect(config).To(Equal(`{"feature1":{"enable":false}}`))
+			Expect(cli.version).To(Equal(server.src.current()))
+		})
+
+		It("should reject a config signed with another key", func() {
+			other, _, _ := ed25519.GenerateKey(rand.Reader)
+			cli := NewClientWithOptions(addr, &ClientOptions{PublicKey: other})
+			Eventually(func() error {
+				_, err := cli.GetConfig()
+				return err
+			}).Should(Equal(ErrBadSignature))
+		})
+
+		It("should reject a version older than the last one accepted", func() {
+			cli := NewClientWithOptions(addr, &ClientOptions{PublicKey: pub})
+			Eventually(func() error {
+				_, err := NewClient(addr).GetConfig()
+				return err
+			}).Should(BeNil())
+
+			// as if a later version had been accepted, the current one is a
+			// replay
+			later := server.src.current() + 1000
+			Expect(cli.accept(later, `{}`)).To(Succeed())
+			_, err := cli.GetConfig()
+			Expect(err).To(Equal(ErrStaleConfig))
+
+			// and so is the same version with another config
+			Expect(cli.accept(later, `{"feature1":{"enable":false}}`)).To(Equal(ErrStaleConfig))
+		})
+
+		It("should accept an older version of the same config", func() {
+			cli := NewClientWithOptions(addr, &ClientOptions{PublicKey: pub})
+			Eventually(func() error {
+				_, err := NewClient(addr).GetConfig()
+				return err
+			}).Should(BeNil())
+
+			// as after a failover to a server that loaded it earlier
+			Expect(cli.accept(server.src.current()+1000, `{"feature1":{"enable":true}}`)).To(Succeed())
+			config, err := cli.GetConfig()
+			Expect(err).To(BeNil())
+			Expect(config).To(Equal(`{"feature1":{"enable":true}}`))
+		})
+
+	})
+
+})
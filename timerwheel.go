@@ -0,0 +1,85 @@
+package cfgsrv
+
+import (
+	"time"
+)
+
+// timerWheel is a hashed timer wheel of addrs. Every slot holds the addrs
+// that are due within the same tick, so scheduling, moving and expiring an
+// addr costs the same no matter how many addrs are tracked. The wheel follows
+// the wall clock rather than counting calls to advance, so a late or
+// jittered tick expires every slot it skipped. Deadlines beyond the span of
+// the wheel are parked in the farthest slot and rescheduled by the caller
+// when they come around. timerWheel is not safe for concurrent use.
+type timerWheel struct {
+	tick  time.Duration
+	slots []map[string]struct{}
+	where map[string]int // addr to slot
+	pos   int
+	now   time.Time // start of the tick of pos
+}
+
+// newTimerWheel creates a timerWheel that starts at now, advances by tick and
+// can hold deadlines up to span in the future
+func newTimerWheel(tick, span time.Duration, now time.Time) *timerWheel {
+	n := int(span/tick) + 2
+	w := &timerWheel{
+		tick:  tick,
+		slots: make([]map[string]struct{}, n),
+		where: make(map[string]int),
+		now:   now,
+	}
+	for i := range w.slots {
+		w.slots[i] = make(map[string]struct{})
+	}
+	return w
+}
+
+// schedule makes addr due at t, replacing any previous deadline. A deadline
+// in the past is due on the next advance.
+func (w *timerWheel) schedule(addr string, t time.Time) {
+	w.remove(addr)
+	d := t.Sub(w.now)
+	n := int((d + w.tick - 1) / w.tick)
+	if n < 1 {
+		n = 1
+	}
+	if n >= len(w.slots) {
+		n = len(w.slots) - 1
+	}
+	slot := (w.pos + n) % len(w.slots)
+	w.slots[slot][addr] = struct{}{}
+	w.where[addr] = slot
+}
+
+// remove cancels the deadline of addr
+func (w *timerWheel) remove(addr string) {
+	if slot, found := w.where[addr]; found {
+		delete(w.slots[slot], addr)
+		delete(w.where, addr)
+	}
+}
+
+// advance moves the wheel up to now and returns the addrs of every slot
+// passed on the way. A whole round at most is walked, after a longer stall
+// every addr is due and the wheel jumps to now.
+func (w *timerWheel) advance(now time.Time) []string {
+	var due []string
+	for i := 0; i < len(w.slots) && !now.Before(w.now.Add(w.tick)); i++ {
+		w.pos = (w.pos + 1) % len(w.slots)
+		w.now = w.now.Add(w.tick)
+		slot := w.slots[w.pos]
+		if len(slot) == 0 {
+			continue
+		}
+		for addr := range slot {
+			due = append(due, addr)
+			delete(w.where, addr)
+		}
+		w.slots[w.pos] = make(map[string]struct{})
+	}
+	if now.Sub(w.now) >= w.tick {
+		w.now = now
+	}
+	return due
+}
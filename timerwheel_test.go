@@ -0,0 +1,89 @@
+package cfgsrv
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("timerWheel", func() {
+
+	var (
+		t0 time.Time
+		w  *timerWheel
+	)
+
+	at := func(ms int) time.Time {
+		return t0.Add(time.Duration(ms) * time.Millisecond)
+	}
+
+	BeforeEach(func() {
+		t0 = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		w = newTimerWheel(10*time.Millisecond, 100*time.Millisecond, t0)
+	})
+
+	It("should expire an addr on the tick of its deadline", func() {
+		w.schedule("a", at(25))
+		Expect(w.advance(at(10))).To(BeEmpty())
+		Expect(w.advance(at(20))).To(BeEmpty())
+		Expect(w.advance(at(30))).To(Equal([]string{"a"}))
+		Expect(w.advance(at(40))).To(BeEmpty())
+	})
+
+	It("should not move before a whole tick has passed", func() {
+		w.schedule("a", at(10))
+		Expect(w.advance(at(9))).To(BeEmpty())
+		Expect(w.advance(at(10))).To(Equal([]string{"a"}))
+	})
+
+	It("should expire every slot passed by a late tick", func() {
+		w.schedule("a", at(15))
+		w.schedule("b", at(35))
+		w.schedule("c", at(65))
+		Expect(w.advance(at(47))).To(ConsistOf("a", "b"))
+		Expect(w.advance(at(70))).To(Equal([]string{"c"}))
+	})
+
+	It("should make a deadline in the past due on the next tick", func() {
+		w.schedule("a", t0.Add(-time.Second))
+		Expect(w.advance(at(10))).To(Equal([]string{"a"}))
+	})
+
+	It("should cancel and replace deadlines", func() {
+		w.schedule("a", at(20))
+		w.schedule("b", at(20))
+		w.remove("a")
+		w.schedule("b", at(50))
+		Expect(w.advance(at(40))).To(BeEmpty())
+		Expect(w.advance(at(50))).To(Equal([]string{"b"}))
+	})
+
+	It("should keep the deadlines across rotations", func() {
+		now := t0
+		for round := 0; round < 3; round++ {
+			w.schedule("a", now.Add(90*time.Millisecond))
+			for i := 1; i < 9; i++ {
+				Expect(w.advance(now.Add(time.Duration(i) * 10 * time.Millisecond))).To(BeEmpty())
+			}
+			now = now.Add(90 * time.Millisecond)
+			Expect(w.advance(now)).To(Equal([]string{"a"}))
+		}
+	})
+
+	It("should park a deadline beyond the span in the farthest slot", func() {
+		w.schedule("a", t0.Add(time.Hour))
+		Expect(w.advance(at(100))).To(BeEmpty())
+		Expect(w.advance(at(110))).To(Equal([]string{"a"}))
+	})
+
+	It("should catch up with the clock after a stall", func() {
+		w.schedule("a", at(20))
+		Expect(w.advance(t0.Add(time.Hour))).To(Equal([]string{"a"}))
+
+		w.schedule("b", t0.Add(time.Hour+20*time.Millisecond))
+		Expect(w.advance(t0.Add(time.Hour + 10*time.Millisecond))).To(BeEmpty())
+		Expect(w.advance(t0.Add(time.Hour + 20*time.Millisecond))).To(Equal([]string{"b"}))
+	})
+
+})
@@ -0,0 +1,140 @@
+package cfgsrv
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// issueCert writes a certificate for cn and its key to dir, signed by the
+// parent certificate and key, or self-signed when parent is nil. It returns
+// the certificate and key for signing other certificates.
+func issueCert(dir, name, cn string, ca bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).To(BeNil())
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:         ca,
+
+		BasicConstraintsValid: true,
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	Expect(err).To(BeNil())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).To(BeNil())
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	Expect(err).To(BeNil())
+	writeTemp(dir, name+".pem", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	writeTemp(dir, name+".key", string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})))
+	return cert, key
+}
+
+var _ = Describe("TLS", func() {
+
+	var (
+		dir    string
+		addr   string
+		server *ConfigServer
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "cfgsrv-tls")
+		Expect(err).To(BeNil())
+
+		ca, caKey := issueCert(dir, "ca", "test-ca", true, nil, nil)
+		issueCert(dir, "server", "127.0.0.1", false, ca, caKey)
+		issueCert(dir, "client", "service-a", false, ca, caKey)
+
+		// only service-a may get the config
+		acl := writeTemp(dir, "acl.json", `{
+			"identities": {"service-a": {"ops": ["get"], "paths": ["*"]}},
+			"default": {"ops": [], "paths": []}
+		}`)
+
+		addr = freeAddr()
+		server = NewConfigServer(&Options{
+			ListenAddr:  addr,
+			ConfigFile:  writeTemp(dir, "config.json", `{"feature1":{"enable":true}}`),
+			ACLFile:     acl,
+			Timeout:     3,
+			TLSCert:     dir + "/server.pem",
+			TLSKey:      dir + "/server.key",
+			TLSClientCA: dir + "/ca.pem",
+			Logger:      NewJSONLogger(ioutil.Discard, LevelError),
+		})
+		go server.Start()
+	})
+
+	AfterEach(func() {
+		server.Stop()
+		os.RemoveAll(dir)
+	})
+
+	It("should take the identity of a client from its certificate", func() {
+		tlsConfig, err := LoadClientTLSConfig(dir+"/ca.pem", dir+"/client.pem", dir+"/client.key")
+		Expect(err).To(BeNil())
+		cli := NewClientWithOptions(addr, &ClientOptions{
+			TLSConfig: tlsConfig,
+			Timeout:   time.Second,
+		})
+		Eventually(func() error {
+			_, err := cli.GetConfig()
+			return err
+		}).Should(BeNil())
+
+		config, err := cli.GetConfig()
+		Expect(err).To(BeNil())
+		Expect(config).To(Equal(`{"feature1":{"enable":true}}`))
+	})
+
+	It("should not give a client without a certificate the identity of another", func() {
+		tlsConfig, err := LoadClientTLSConfig(dir+"/ca.pem", "", "")
+		Expect(err).To(BeNil())
+		cli := NewClientWithOptions(addr, &ClientOptions{
+			TLSConfig: tlsConfig,
+			Timeout:   time.Second,
+		})
+		Eventually(func() error {
+			_, err := cli.GetConfig()
+			return err
+		}).Should(MatchError("get: " + ErrForbidden.Error()))
+	})
+
+	It("should not accept plaintext websocket connections", func() {
+		// wait for the listener with a TLS client first
+		tlsConfig, err := LoadClientTLSConfig(dir+"/ca.pem", dir+"/client.pem", dir+"/client.key")
+		Expect(err).To(BeNil())
+		Eventually(func() error {
+			_, err := NewClientWithOptions(addr, &ClientOptions{TLSConfig: tlsConfig}).GetConfig()
+			return err
+		}).Should(BeNil())
+
+		cli := NewClientWithOptions("ws://"+addr, &ClientOptions{
+			Timeout: time.Second,
+		})
+		_, err = cli.GetConfig()
+		Expect(err).NotTo(BeNil())
+	})
+
+})
@@ -0,0 +1,140 @@
+package cfgsrv
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DefaultMaxMessageSize is the largest message accepted when
+// Options.MaxMessageSize is not set
+const DefaultMaxMessageSize = 64 * 1024
+
+// maxIDLength is the longest request ID accepted
+const maxIDLength = 128
+
+// maxGroupLength is the longest peer group accepted
+const maxGroupLength = 64
+
+var (
+	// ErrMessageTooLarge is the error of a message over Options.MaxMessageSize
+	ErrMessageTooLarge = errors.New("message too large")
+
+	// ErrInvalidMessage is the error of a message that is not a JSON Message
+	ErrInvalidMessage = errors.New("invalid message")
+)
+
+// requestOPs are the operations clients may request
+var requestOPs = map[string]bool{
+	OPAuth:       true,
+	OPGet:        true,
+	OPConnect:    true,
+	OPDisconnect: true,
+	OPHealth:     true,
+	OPPeers:      true,
+	OPPing:       true,
+	OPStats:      true,
+	OPQueues:     true,
+}
+
+// responseOPs are the responses clients may send to server requests
+var responseOPs = map[string]bool{
+	OPPong: true,
+}
+
+// validate checks the type, ID and op of a message received from a client,
+// and normalizes the addr of a connect
+func (m *Message) validate() error {
+	switch m.Type {
+	case TypeRequest:
+		if !requestOPs[m.OP] {
+			return fmt.Errorf("unknown op: %q", m.OP)
+		}
+	case TypeResponse:
+		if !responseOPs[m.OP] {
+			return fmt.Errorf("unexpected response op: %q", m.OP)
+		}
+	default:
+		return fmt.Errorf("invalid type: %q", m.Type)
+	}
+
+	if m.ID == "" || len(m.ID) > maxIDLength {
+		return fmt.Errorf("invalid id: %q", m.ID)
+	}
+
+	// a wildcard host is filled in from the remote address, see observeAddr
+	if m.OP == OPConnect {
+		addr, err := normalizeAddr(m.Addr)
+		if err != nil {
+			return err
+		}
+		m.Addr = addr
+		if !validGroup(m.Group) {
+			return fmt.Errorf("invalid group: %q", m.Group)
+		}
+	}
+	return nil
+}
+
+// validGroup reports whether group is empty or a name of letters, digits,
+// '-', '_' and '.'. Groups are metric labels, so they are kept short.
+func validGroup(group string) bool {
+	if len(group) > maxGroupLength {
+		return false
+	}
+	for _, r := range group {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeAddr parses a host:port peer address. IP hosts are written in
+// their canonical form, with brackets for IPv6, and hostnames in lower case.
+// The host may be empty.
+func normalizeAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid addr: %q", addr)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 1 || p > 65535 {
+		return "", fmt.Errorf("invalid addr port: %q", addr)
+	}
+	if host == "" {
+		return net.JoinHostPort("", strconv.Itoa(p)), nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return net.JoinHostPort(ip.String(), strconv.Itoa(p)), nil
+	}
+	if !validHostname(host) {
+		return "", fmt.Errorf("invalid addr host: %q", addr)
+	}
+	return net.JoinHostPort(strings.ToLower(host), strconv.Itoa(p)), nil
+}
+
+// validHostname reports whether host is a DNS hostname
+func validHostname(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			switch {
+			case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-':
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,156 @@
+package cfgsrv
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/tonjun/pubsub"
+)
+
+const (
+	// defaultWait is the wait of a long poll GET /v1/config without a wait
+	// parameter
+	defaultWait = 30 * time.Second
+
+	// maxWait is the longest wait of a long poll GET /v1/config
+	maxWait = 5 * time.Minute
+
+	// keepaliveInterval is the interval of the comments that keep an idle
+	// event stream open through proxies
+	keepaliveInterval = 15 * time.Second
+)
+
+// serveWatch serves GET /v1/watch, a Server-Sent Events stream of the
+// config_changed and peers_changed pushes. The stream starts with the
+// current config, and the current peer list if the identity may read it.
+func (s *ConfigServer) serveWatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+
+	identity, err := s.gatewayIdentity(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	c := newGatewayConn(s, r)
+	if !s.openGatewayConn(w, c, identity) {
+		return
+	}
+	defer c.Close()
+
+	// watch before reading the current state so no change is missed in
+	// between, the pushes wait in the events until the stream starts
+	watchPeers := s.src.acl.Allow(identity, OPPeers)
+	atomic.StoreInt32(&c.watching, 1)
+	s.gw.mtx.Lock()
+	s.gw.watchers[c] = watchPeers
+	s.gw.mtx.Unlock()
+
+	config, err := c.request(&Message{
+		OP:   OPGet,
+		Type: TypeRequest,
+		ID:   OPGet,
+	})
+	if err != nil || config.Error != "" {
+		writeResponseError(w, config, err)
+		return
+	}
+	var peers *Message
+	if watchPeers {
+		peers, err = c.request(&Message{
+			OP:   OPPeers,
+			Type: TypeRequest,
+			ID:   OPPeers,
+		})
+		if err != nil || peers.Error != "" {
+			writeResponseError(w, peers, err)
+			return
+		}
+	}
+	s.log.Info("watch started", Fields{"conn_id": c.ID(), "identity": identity, "peers": watchPeers})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	config.OP = OPConfigChanged
+	config.Type = TypePush
+	config.ID = fmt.Sprintf("config-%d", config.Version)
+	writeEvent(w, OPConfigChanged, config.ToBytes())
+	if watchPeers {
+		mesg := &Message{
+			OP:     OPPeersChanged,
+			Type:   TypePush,
+			ID:     "0",
+			Peers:  peers.Peers,
+			States: peers.States,
+		}
+		writeEvent(w, OPPeersChanged, mesg.ToBytes())
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case data := <-c.events:
+			var m struct {
+				OP string `json:"op"`
+			}
+			json.Unmarshal(data, &m)
+			writeEvent(w, m.OP, data)
+			flusher.Flush()
+			if m.OP == OPClosing {
+				return
+			}
+
+		case <-keepalive.C:
+			io.WriteString(w, ": keepalive\n\n")
+			flusher.Flush()
+
+		case <-r.Context().Done():
+			return
+
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// gatewayWatchers returns the watch streams, only those that see the peer
+// list when peers is set
+func (s *ConfigServer) gatewayWatchers(peers bool) []pubsub.Conn {
+	s.gw.mtx.Lock()
+	defer s.gw.mtx.Unlock()
+	conns := make([]pubsub.Conn, 0, len(s.gw.watchers))
+	for c, watchPeers := range s.gw.watchers {
+		if watchPeers || !peers {
+			conns = append(conns, c)
+		}
+	}
+	return conns
+}
+
+// pushWatchers passes a peers_changed push on to the watch streams
+func (s *ConfigServer) pushWatchers(m *Message) {
+	if conns := s.gatewayWatchers(true); len(conns) > 0 {
+		s.bc.Broadcast(conns, m)
+	}
+}
+
+// writeEvent writes a Server-Sent Event. data is a single line of JSON.
+func writeEvent(w io.Writer, event string, data []byte) {
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+}
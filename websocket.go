@@ -0,0 +1,181 @@
+package cfgsrv
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// writeWait is the time allowed to write a message to a websocket client
+const writeWait = 10 * time.Second
+
+// wsConn is a websocket client connection
+type wsConn struct {
+	id       int64
+	ws       *websocket.Conn
+	remote   net.Addr
+	identity string // from the verified client certificate, if any
+	writeMtx sync.Mutex
+}
+
+// ID returns the unique ID of the connection
+func (c *wsConn) ID() int64 {
+	return c.id
+}
+
+// Send writes b to the client as a text message
+func (c *wsConn) Send(b []byte) error {
+	c.writeMtx.Lock()
+	defer c.writeMtx.Unlock()
+	c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.ws.WriteMessage(websocket.TextMessage, b)
+}
+
+// Close closes the underlying network connection
+func (c *wsConn) Close() error {
+	return c.ws.Close()
+}
+
+// RemoteAddr returns the address of the client
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// wsServer accepts the websocket connections on Options.ListenAddr.
+// TLS is terminated by its own listener so no plaintext path to the
+// server exists when Options.TLSCert is set.
+type wsServer struct {
+	ln       net.Listener
+	srv      *http.Server
+	upgrader *websocket.Upgrader
+	identity func(*x509.Certificate) string
+	connID   int64 // atomic, last connection ID
+	conns    map[*wsConn]struct{}
+	mtx      sync.Mutex
+}
+
+// listen opens the websocket listener, TLS when cfg is not nil
+func listen(addr string, cfg *tls.Config) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if cfg != nil {
+		ln = tls.NewListener(ln, cfg)
+	}
+	return ln, nil
+}
+
+// newHTTPServer returns an http.Server with the timeouts that keep slow
+// clients from holding connections open
+func newHTTPServer(h http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           h,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+		MaxHeaderBytes:    16 << 10,
+	}
+}
+
+// startWS opens the websocket listener
+func (s *ConfigServer) startWS(cfg *tls.Config) error {
+	ln, err := listen(s.opts.ListenAddr, cfg)
+	if err != nil {
+		return err
+	}
+	identity := s.opts.TLSIdentity
+	if identity == nil {
+		identity = certIdentity
+	}
+	s.ws = &wsServer{
+		ln: ln,
+		upgrader: &websocket.Upgrader{
+			HandshakeTimeout: 10 * time.Second,
+			// the clients are services, not browsers
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+		identity: identity,
+		conns:    make(map[*wsConn]struct{}),
+	}
+	s.ws.srv = newHTTPServer(http.HandlerFunc(s.serveWS))
+	return nil
+}
+
+// runWS serves the websocket connections until Stop
+func (s *ConfigServer) runWS() error {
+	if err := s.ws.srv.Serve(s.ws.ln); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// stopWS closes the listener and every open connection
+func (s *ConfigServer) stopWS() {
+	if s.ws == nil {
+		return
+	}
+	s.ws.srv.Close()
+	s.ws.ln.Close()
+
+	// http.Server.Close does not close the hijacked connections
+	s.ws.mtx.Lock()
+	for c := range s.ws.conns {
+		c.Close()
+	}
+	s.ws.mtx.Unlock()
+}
+
+// serveWS upgrades a request to a websocket connection and reads its
+// messages until it is closed
+func (s *ConfigServer) serveWS(w http.ResponseWriter, r *http.Request) {
+	ws, err := s.ws.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.log.Debug("websocket upgrade error", Fields{"remote": r.RemoteAddr, "error": err})
+		return
+	}
+	c := &wsConn{
+		id:     atomic.AddInt64(&s.ws.connID, 1),
+		ws:     ws,
+		remote: ws.RemoteAddr(),
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		c.identity = s.ws.identity(r.TLS.PeerCertificates[0])
+	}
+
+	s.ws.mtx.Lock()
+	s.ws.conns[c] = struct{}{}
+	s.ws.mtx.Unlock()
+	defer func() {
+		s.ws.mtx.Lock()
+		delete(s.ws.conns, c)
+		s.ws.mtx.Unlock()
+		c.Close()
+	}()
+
+	// a frame over the limit is not read into memory, the connection is
+	// closed with a message too big close frame
+	ws.SetReadLimit(int64(s.maxMessageSize()))
+
+	if err := s.onConnect(c); err != nil {
+		return
+	}
+	defer s.onConnectionWillClose(c)
+	for {
+		_, data, err := ws.ReadMessage()
+		if err == websocket.ErrReadLimit {
+			s.log.Warn("message too large", Fields{"conn_id": c.ID(), "limit": s.maxMessageSize()})
+			return
+		}
+		if err != nil {
+			s.log.Debug("websocket read error", Fields{"conn_id": c.ID(), "error": err})
+			return
+		}
+		s.onMessage(data, c)
+	}
+}
@@ -0,0 +1,62 @@
+package cfgsrv
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("wsServer", func() {
+
+	var (
+		dir    string
+		addr   string
+		server *ConfigServer
+	)
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "cfgsrv-ws")
+		Expect(err).To(BeNil())
+		addr = freeAddr()
+		server = NewConfigServer(&Options{
+			ListenAddr:     addr,
+			ConfigFile:     writeTemp(dir, "config.json", `{"feature1":{"enable":true}}`),
+			Timeout:        3,
+			MaxMessageSize: 1024,
+			Logger:         NewJSONLogger(ioutil.Discard, LevelError),
+		})
+		go server.Start()
+		Eventually(func() error {
+			_, err := NewClient(addr).GetConfig()
+			return err
+		}).Should(BeNil())
+	})
+
+	AfterEach(func() {
+		server.Stop()
+		os.RemoveAll(dir)
+	})
+
+	It("should close a connection that sends a message over the read limit", func() {
+		conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr, nil)
+		Expect(err).To(BeNil())
+		defer conn.Close()
+
+		get := `{"op":"get","type":"request","id":"` + strings.Repeat("x", 2048) + `"}`
+		Expect(conn.WriteMessage(websocket.TextMessage, []byte(get))).To(Succeed())
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, _, err = conn.ReadMessage()
+		closeErr, ok := err.(*websocket.CloseError)
+		Expect(ok).To(BeTrue())
+		Expect(closeErr.Code).To(Equal(websocket.CloseMessageTooBig))
+	})
+
+})